@@ -0,0 +1,105 @@
+package keys
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// IP keys requests by the IP address of the client. The address the request
+// comes from is the client's, unless it is one of the trusted proxies (CIDR
+// ranges or addresses). Then the client is the last address of the
+// X-Forwarded-For header (or of the Forwarded header, without one) that is
+// not a trusted proxy, as anyone can prepend addresses to these headers.
+func IP(trustedProxies ...string) (Func, error) {
+	var trusted []*net.IPNet
+	for _, proxy := range trustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an IP address", proxy)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			trusted = append(trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy: %w", err)
+		}
+		trusted = append(trusted, ipNet)
+	}
+
+	isTrusted := func(ip net.IP) bool {
+		for _, ipNet := range trusted {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(r *http.Request) (string, bool) {
+		ip := parseIP(r.RemoteAddr)
+		if ip == nil {
+			return "", false
+		}
+		if !isTrusted(ip) {
+			return ip.String(), true
+		}
+		hops := forwardedFor(r)
+		// the hops are walked back from the proxy the request came from
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := parseIP(hops[i])
+			if hop == nil {
+				break
+			}
+			ip = hop
+			if !isTrusted(hop) {
+				break
+			}
+		}
+		return ip.String(), true
+	}, nil
+}
+
+// forwardedFor returns the addresses the request was forwarded for, from the
+// X-Forwarded-For header or else the Forwarded header, client first
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+	if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		for _, value := range values {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+		return hops
+	}
+	for _, value := range r.Header.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, hop, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(name, "for") {
+					hops = append(hops, strings.Trim(hop, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseIP parses an IP address, with or without a port, as in "[::1]:80"
+func parseIP(address string) net.IP {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	return net.ParseIP(strings.Trim(address, "[]"))
+}
@@ -0,0 +1,95 @@
+package keys
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JWTClaim keys requests by a claim of the JWT in their bearer token, e.g.
+// "sub". Only tokens signed with HS256 and the secret are trusted, and only
+// while they are valid (exp and nbf). Requests without a valid token, or
+// whose token lacks the claim, have no key.
+func JWTClaim(claim string, secret []byte) (Func, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("jwt: the secret to verify tokens with is missing")
+	}
+	return func(r *http.Request) (string, bool) {
+		claims, err := verifyHS256(bearer(r), secret, time.Now())
+		if err != nil {
+			return "", false
+		}
+		switch value := claims[claim].(type) {
+		case string:
+			return value, value != ""
+		case json.Number:
+			return value.String(), true
+		default:
+			return "", false
+		}
+	}, nil
+}
+
+// verifyHS256 verifies the signature and validity of the token, and returns
+// its claims
+func verifyHS256(token string, secret []byte, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("jwt: malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("jwt: unsupported algorithm %q", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("jwt: %w", err)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("jwt: invalid signature")
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if exp, ok := claims["exp"].(json.Number); ok {
+		if seconds, err := exp.Int64(); err != nil || !now.Before(time.Unix(seconds, 0)) {
+			return nil, fmt.Errorf("jwt: token expired")
+		}
+	}
+	if nbf, ok := claims["nbf"].(json.Number); ok {
+		if seconds, err := nbf.Int64(); err != nil || now.Before(time.Unix(seconds, 0)) {
+			return nil, fmt.Errorf("jwt: token not valid yet")
+		}
+	}
+	return claims, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token into v
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("jwt: %w", err)
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("jwt: %w", err)
+	}
+	return nil
+}
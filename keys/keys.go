@@ -0,0 +1,214 @@
+// Package keys extracts the key a request is rate limited by, e.g. its user,
+// IP address, API key or a claim of its JWT.
+package keys
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Func extracts the key of a request. ok is false if the request has none,
+// e.g. the header the key is read from is missing.
+type Func func(r *http.Request) (key string, ok bool)
+
+// Header keys requests by the value of the header
+func Header(name string) Func {
+	return func(r *http.Request) (string, bool) {
+		value := r.Header.Get(name)
+		return value, value != ""
+	}
+}
+
+// Query keys requests by the value of the query parameter
+func Query(name string) Func {
+	return func(r *http.Request) (string, bool) {
+		value := r.URL.Query().Get(name)
+		return value, value != ""
+	}
+}
+
+// APIKey keys requests by the API key in the header, or the bearer token of
+// the Authorization header if name is "Authorization". The key is a hash of
+// the API key, so the API keys do not leak through the limiter's stats.
+func APIKey(name string) Func {
+	return func(r *http.Request) (string, bool) {
+		value := r.Header.Get(name)
+		if strings.EqualFold(name, "Authorization") {
+			value = bearer(r)
+		}
+		if value == "" {
+			return "", false
+		}
+		sum := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(sum[:8]), true
+	}
+}
+
+// bearer returns the bearer token of the Authorization header
+func bearer(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// Route keys requests by their method and path, e.g. "GET /users/42"
+func Route(r *http.Request) (string, bool) {
+	return r.Method + " " + r.URL.Path, true
+}
+
+// PathParam keys requests by a parameter of their path. The pattern has one
+// placeholder, e.g. "/users/{id}", and other segments must match exactly.
+// Requests whose path does not match the pattern have no key.
+func PathParam(pattern string) (Func, error) {
+	segments := strings.Split(strings.Trim(pattern, "/"), "/")
+	param := -1
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if param >= 0 {
+				return nil, fmt.Errorf("path pattern %q has more than one placeholder", pattern)
+			}
+			param = i
+		}
+	}
+	if param < 0 {
+		return nil, fmt.Errorf("path pattern %q has no placeholder", pattern)
+	}
+
+	return func(r *http.Request) (string, bool) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != len(segments) || parts[param] == "" {
+			return "", false
+		}
+		for i, segment := range segments {
+			if i != param && parts[i] != segment {
+				return "", false
+			}
+		}
+		return parts[param], true
+	}, nil
+}
+
+// Const keys every request by the key, e.g. to let the requests without a key
+// share one
+func Const(key string) Func {
+	return func(*http.Request) (string, bool) { return key, true }
+}
+
+// Composite keys requests by the keys of all the parts joined by ":", e.g.
+// the user and the route. A request has no key if any part is missing.
+func Composite(parts ...Func) Func {
+	return func(r *http.Request) (string, bool) {
+		keys := make([]string, len(parts))
+		for i, part := range parts {
+			key, ok := part(r)
+			if !ok {
+				return "", false
+			}
+			keys[i] = key
+		}
+		return strings.Join(keys, ":"), true
+	}
+}
+
+// Fallback keys requests by the first of the alternatives they have a key
+// for, e.g. the user and, for anonymous requests, the IP address
+func Fallback(alternatives ...Func) Func {
+	return func(r *http.Request) (string, bool) {
+		for _, alternative := range alternatives {
+			if key, ok := alternative(r); ok {
+				return key, true
+			}
+		}
+		return "", false
+	}
+}
+
+// Config holds what the extractors of Parse need besides the request
+type Config struct {
+	// TrustedProxies are the CIDR ranges (or addresses) of the proxies whose
+	// X-Forwarded-For and Forwarded headers are trusted
+	TrustedProxies []string
+	// JWTSecret is the key the HS256 signature of JWTs is verified with
+	JWTSecret []byte
+}
+
+// Parse creates the extractor described by spec. Alternatives are separated
+// by "|" (see Fallback) and the parts of a composite key by "+" (see
+// Composite). An extractor is one of:
+//
+//	ip              : the client's IP address, see IP
+//	header:<name>   : a header
+//	query:<name>    : a query parameter
+//	api_key:<name>  : the hash of the API key in a header
+//	jwt:<claim>     : a claim of the JWT bearer token, see JWTClaim
+//	path:<pattern>  : a parameter of the path, see PathParam
+//	route           : the method and path
+//	const:<key>     : a fixed key
+//
+// For example "jwt:sub+route|ip" keys the requests by user and route, and the
+// anonymous ones by IP address.
+func Parse(spec string, config Config) (Func, error) {
+	var alternatives []Func
+	for _, alternative := range strings.Split(spec, "|") {
+		var parts []Func
+		for _, part := range strings.Split(alternative, "+") {
+			f, err := parseOne(strings.TrimSpace(part), config)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, f)
+		}
+		if len(parts) == 1 {
+			alternatives = append(alternatives, parts[0])
+		} else {
+			alternatives = append(alternatives, Composite(parts...))
+		}
+	}
+	if len(alternatives) == 1 {
+		return alternatives[0], nil
+	}
+	return Fallback(alternatives...), nil
+}
+
+// parseOne creates the extractor of a single part of a spec
+func parseOne(spec string, config Config) (Func, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	needsArg := func() error {
+		if arg == "" {
+			return fmt.Errorf("key %q: missing the %s's argument", spec, kind)
+		}
+		return nil
+	}
+	switch kind {
+	case "ip":
+		return IP(config.TrustedProxies...)
+	case "route":
+		return Route, nil
+	case "header", "query", "api_key", "jwt", "path", "const":
+		if err := needsArg(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("key %q: unknown extractor %q", spec, kind)
+	}
+
+	switch kind {
+	case "header":
+		return Header(arg), nil
+	case "query":
+		return Query(arg), nil
+	case "api_key":
+		return APIKey(arg), nil
+	case "jwt":
+		return JWTClaim(arg, config.JWTSecret)
+	case "path":
+		return PathParam(arg)
+	default:
+		return Const(arg), nil
+	}
+}
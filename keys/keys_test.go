@@ -0,0 +1,134 @@
+package keys
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// request creates a request to the target from the address, with the headers
+func request(target, remoteAddr string, headers map[string]string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.RemoteAddr = remoteAddr
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	return r
+}
+
+// token creates a JWT with the claims, signed with HS256 and the secret
+func token(alg, claims string, secret []byte) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	unsigned := encode([]byte(`{"alg":"`+alg+`","typ":"JWT"}`)) + "." + encode([]byte(claims))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + encode(mac.Sum(nil))
+}
+
+// check runs the extractor on the request and checks the key it extracts
+func check(t *testing.T, name string, f Func, r *http.Request, want string, wantOK bool) {
+	t.Helper()
+	if key, ok := f(r); key != want || ok != wantOK {
+		t.Errorf("%s: expected (%q, %v), got (%q, %v)", name, want, wantOK, key, ok)
+	}
+}
+
+func TestIP(t *testing.T) {
+	ip, err := IP("10.0.0.0/8", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"direct", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted proxy", "203.0.113.5:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.5"},
+		{"trusted proxy", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		// the client can prepend anything, only the hops added by trusted proxies count
+		{"spoofed hop", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"forwarded", "192.0.2.1:1234", map[string]string{"Forwarded": `for="[2001:db8::1]:4711";proto=https`}, "2001:db8::1"},
+		{"only proxies", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.2"}, "10.0.0.2"},
+	} {
+		check(t, tc.name, ip, request("/", tc.remoteAddr, tc.headers), tc.want, true)
+	}
+
+	if _, err := IP("not-an-ip"); err == nil {
+		t.Error("expected an invalid trusted proxy to be refused")
+	}
+}
+
+func TestJWTClaim(t *testing.T) {
+	secret := []byte("secret")
+	sub, err := JWTClaim("sub", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		token  string
+		want   string
+		wantOK bool
+	}{
+		{"valid", token("HS256", `{"sub":"alice","exp":4102444800}`, secret), "alice", true},
+		{"numeric claim", token("HS256", `{"sub":42}`, secret), "42", true},
+		{"wrong secret", token("HS256", `{"sub":"alice"}`, []byte("guess")), "", false},
+		{"expired", token("HS256", `{"sub":"alice","exp":946684800}`, secret), "", false},
+		{"not valid yet", token("HS256", `{"sub":"alice","nbf":4102444800}`, secret), "", false},
+		{"other algorithm", token("none", `{"sub":"alice"}`, secret), "", false},
+		{"missing claim", token("HS256", `{"name":"alice"}`, secret), "", false},
+		{"malformed", "not.a-token", "", false},
+	} {
+		r := request("/", "203.0.113.5:1234", map[string]string{"Authorization": "Bearer " + tc.token})
+		check(t, tc.name, sub, r, tc.want, tc.wantOK)
+	}
+
+	if _, err := JWTClaim("sub", nil); err == nil {
+		t.Error("expected a missing secret to be refused")
+	}
+}
+
+func TestExtractors(t *testing.T) {
+	r := request("/users/42/posts?tenant=acme", "203.0.113.5:1234", map[string]string{
+		"X-User": "alice", "X-API-Key": "s3cr3t", "Authorization": "Bearer s3cr3t",
+	})
+	posts, err := PathParam("/users/{id}/posts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, "header", Header("X-User"), r, "alice", true)
+	check(t, "missing header", Header("X-Org"), r, "", false)
+	check(t, "query", Query("tenant"), r, "acme", true)
+	check(t, "path", posts, r, "42", true)
+	check(t, "other path", posts, request("/users/42", "", nil), "", false)
+	check(t, "route", Route, r, "GET /users/42/posts", true)
+	check(t, "composite", Composite(Header("X-User"), Query("tenant")), r, "alice:acme", true)
+	check(t, "composite missing", Composite(Header("X-User"), Header("X-Org")), r, "", false)
+	check(t, "fallback", Fallback(Header("X-Org"), Const("anonymous")), r, "anonymous", true)
+
+	// API keys are hashed, the same in a header or as a bearer token
+	apiKey, _ := APIKey("X-API-Key")(r)
+	if bearer, _ := APIKey("Authorization")(r); apiKey == "s3cr3t" || apiKey == "" || apiKey != bearer {
+		t.Errorf("expected the API key to be hashed the same, got %q and %q", apiKey, bearer)
+	}
+}
+
+func TestParse(t *testing.T) {
+	f, err := Parse("header:X-User+route|ip", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, "user and route", f, request("/a", "203.0.113.5:1234", map[string]string{"X-User": "alice"}), "alice:GET /a", true)
+	check(t, "anonymous", f, request("/a", "203.0.113.5:1234", nil), "203.0.113.5", true)
+
+	for _, spec := range []string{"cookie:session", "header", "jwt:sub", "path:/users", "ip|query:"} {
+		if _, err := Parse(spec, Config{}); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package limiter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrDenied = fmt.Errorf("key is denied")
+)
+
+// Access is the outcome of matching a request against AccessRules
+type Access int
+
+const (
+	// AccessNone means no rule matched, the request is rate limited
+	AccessNone Access = iota
+	// AccessAllow means the request skips rate limiting
+	AccessAllow
+	// AccessDeny means the request is rejected without being rate limited
+	AccessDeny
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessAllow:
+		return "allow"
+	case AccessDeny:
+		return "deny"
+	default:
+		return "none"
+	}
+}
+
+// AccessRules are allow and deny rules, matched against the keys (and IP
+// addresses) of requests. A deny rule takes precedence over an allow rule.
+// AccessRules are not modified once created, they are replaced as a whole.
+//
+// The rules are written one per line, as "allow <pattern>" or "deny <pattern>".
+// Empty lines and lines starting with # are ignored. A pattern is one of:
+//
+//	re:<regexp>    : a regular expression, e.g. re:^scraper-[0-9]+$
+//	<ip>/<bits>    : an IPv4 or IPv6 CIDR range, e.g. 10.0.0.0/8 or fd00::/8
+//	<ip>           : a single IP address
+//	glob           : a pattern with * (any characters) or ? (one character)
+//	anything else  : the exact key
+type AccessRules struct {
+	rules []accessRule
+	// path is the file the rules were loaded from, if any
+	path string
+}
+
+// accessRule is a single allow or deny rule
+type accessRule struct {
+	access  Access
+	pattern string
+	match   func(string) bool
+}
+
+// ParseAccessRules parses the rules read from r
+func ParseAccessRules(r io.Reader) (*AccessRules, error) {
+	rules := &AccessRules{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		verb, pattern, _ := strings.Cut(text, " ")
+		rule, err := newAccessRule(verb, strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		rules.rules = append(rules.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// LoadAccessRules loads the rules from the file at path
+func LoadAccessRules(path string) (*AccessRules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rules, err := ParseAccessRules(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rules.path = path
+	return rules, nil
+}
+
+// Reload loads the rules again from the file they were loaded from
+func (r *AccessRules) Reload() (*AccessRules, error) {
+	if r == nil || r.path == "" {
+		return nil, fmt.Errorf("the access rules were not loaded from a file")
+	}
+	return LoadAccessRules(r.path)
+}
+
+// newAccessRule creates the rule allowing or denying the pattern
+func newAccessRule(verb, pattern string) (accessRule, error) {
+	rule := accessRule{pattern: pattern}
+	switch verb {
+	case "allow":
+		rule.access = AccessAllow
+	case "deny":
+		rule.access = AccessDeny
+	default:
+		return rule, fmt.Errorf("expected allow or deny, got %q", verb)
+	}
+	if pattern == "" {
+		return rule, fmt.Errorf("%s: missing pattern", verb)
+	}
+
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, "re:"))
+		if err != nil {
+			return rule, err
+		}
+		rule.match = re.MatchString
+		return rule, nil
+	}
+	if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+		rule.match = func(key string) bool {
+			ip := parseIP(key)
+			return ip != nil && ipNet.Contains(ip)
+		}
+		return rule, nil
+	}
+	if ip := net.ParseIP(pattern); ip != nil {
+		rule.match = func(key string) bool { return ip.Equal(parseIP(key)) }
+		return rule, nil
+	}
+	if strings.ContainsAny(pattern, "*?") {
+		expr := regexp.QuoteMeta(pattern)
+		expr = strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(expr)
+		re := regexp.MustCompile("^" + expr + "$")
+		rule.match = re.MatchString
+		return rule, nil
+	}
+	rule.match = func(key string) bool { return key == pattern }
+	return rule, nil
+}
+
+// parseIP parses the key as an IP address, with or without a port
+func parseIP(key string) net.IP {
+	if host, _, err := net.SplitHostPort(key); err == nil {
+		key = host
+	}
+	return net.ParseIP(key)
+}
+
+// Match matches the subjects of a request (e.g. its key and IP address)
+// against the rules
+func (r *AccessRules) Match(subjects ...string) Access {
+	if r == nil {
+		return AccessNone
+	}
+	access := AccessNone
+	for _, rule := range r.rules {
+		for _, subject := range subjects {
+			if subject == "" || !rule.match(subject) {
+				continue
+			}
+			if rule.access == AccessDeny {
+				return AccessDeny
+			}
+			access = AccessAllow
+		}
+	}
+	return access
+}
+
+// Strings returns the rules, as they are written
+func (r *AccessRules) Strings() []string {
+	lines := make([]string, 0)
+	if r == nil {
+		return lines
+	}
+	for _, rule := range r.rules {
+		lines = append(lines, rule.access.String()+" "+rule.pattern)
+	}
+	return lines
+}
+
+// Len returns the number of rules
+func (r *AccessRules) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.rules)
+}
+
+// AccessList wraps a RateLimiter with allow and deny rules matched against
+// the keys: the requests of allowed keys skip the wrapped limiter, and those
+// of denied keys are rejected without reaching it. The rules can be replaced
+// at any time.
+type AccessList struct {
+	limiter RateLimiter
+
+	mu    sync.RWMutex
+	rules *AccessRules
+	// allowed and denied count the requests matching the rules
+	allowed atomic.Int64
+	denied  atomic.Int64
+
+	// inFlight counts the in flight slots each key took from the wrapped
+	// limiter, so only those are released whatever the rules are by then
+	inFlightMu sync.Mutex
+	inFlight   map[string]int
+}
+
+// NewAccessList wraps the limiter with the rules
+func NewAccessList(limiter RateLimiter, rules *AccessRules) *AccessList {
+	return &AccessList{limiter: limiter, rules: rules, inFlight: make(map[string]int)}
+}
+
+// Rules returns the current rules
+func (a *AccessList) Rules() *AccessRules {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.rules
+}
+
+// SetRules replaces the rules
+func (a *AccessList) SetRules(rules *AccessRules) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = rules
+}
+
+// match matches the key against the rules and counts the matching requests
+func (a *AccessList) match(key string) Access {
+	access := a.Rules().Match(key)
+	switch access {
+	case AccessAllow:
+		a.allowed.Add(1)
+	case AccessDeny:
+		a.denied.Add(1)
+	}
+	return access
+}
+
+// Allow checks if a request can be allowed
+func (a *AccessList) Allow(key string) error {
+	return a.AllowN(key, 1)
+}
+
+// AllowN checks if a request costing n tokens can be allowed. Requests of a
+// denied key are rejected with ErrDenied.
+func (a *AccessList) AllowN(key string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	switch a.match(key) {
+	case AccessAllow:
+		return nil
+	case AccessDeny:
+		return ErrDenied
+	}
+	if err := a.limiter.AllowN(key, n); err != nil {
+		return err
+	}
+	a.took(key, n)
+	return nil
+}
+
+// Decide checks if a request can be allowed
+func (a *AccessList) Decide(key string) Decision {
+	return a.decide(key, func() Decision { return a.limiter.Decide(key) })
+}
+
+// DecidePriority checks if a request of the priority class can be allowed. The
+// priority is ignored if the wrapped limiter does not take it into account.
+func (a *AccessList) DecidePriority(key string, priority Priority) Decision {
+	return a.decide(key, func() Decision {
+		if l, ok := a.limiter.(PriorityAware); ok {
+			return l.DecidePriority(key, priority)
+		}
+		return a.limiter.Decide(key)
+	})
+}
+
+// decide answers for the keys matching the rules, and decides with the
+// wrapped limiter for the others
+func (a *AccessList) decide(key string, decide func() Decision) Decision {
+	limit := a.limiter.GetLimit()
+	switch a.match(key) {
+	case AccessAllow:
+		return Decision{Allowed: true, Limit: limit, Remaining: limit}
+	case AccessDeny:
+		return Decision{Limit: limit, RetryAfter: maxWait}
+	}
+	d := decide()
+	if d.Allowed {
+		a.took(key, 1)
+	}
+	return d
+}
+
+// took records that the key took n in flight slots of the wrapped limiter,
+// if it limits requests in flight. Wrappers like PenaltyBox release slots
+// whatever they wrap, so the limiter really holding slots is looked for.
+func (a *AccessList) took(key string, n int) {
+	if _, ok := unwrap[*ConcurrencyLimiter](a.limiter); !ok || n == 0 {
+		return
+	}
+	a.inFlightMu.Lock()
+	defer a.inFlightMu.Unlock()
+	a.inFlight[key] += n
+}
+
+// Done releases the in flight slot of the key, if the wrapped limiter limits
+// requests in flight. The requests of allowed keys do not take a slot.
+func (a *AccessList) Done(key string) {
+	a.DoneN(key, 1)
+}
+
+// DoneN releases n in flight slots of the key, see Done. Only the slots the
+// key took from the wrapped limiter are released, even if the rules changed
+// since.
+func (a *AccessList) DoneN(key string, n int) {
+	l, ok := a.limiter.(InFlightLimiter)
+	if !ok || n <= 0 {
+		return
+	}
+	a.inFlightMu.Lock()
+	if taken := a.inFlight[key]; n >= taken {
+		n = taken
+		delete(a.inFlight, key)
+	} else {
+		a.inFlight[key] = taken - n
+	}
+	a.inFlightMu.Unlock()
+	if n > 0 {
+		l.DoneN(key, n)
+	}
+}
+
+// Unwrap returns the wrapped limiter
+func (a *AccessList) Unwrap() RateLimiter { return a.limiter }
+
+func (a *AccessList) Unregister(key string) {
+	a.inFlightMu.Lock()
+	delete(a.inFlight, key)
+	a.inFlightMu.Unlock()
+	a.limiter.Unregister(key)
+}
+
+// Stop stops the wrapped limiter
+func (a *AccessList) Stop() { a.limiter.Stop() }
+
+// Stats returns the stats of the wrapped limiter and the requests matching
+// the rules
+func (a *AccessList) Stats() interface{} {
+	return map[string]interface{}{
+		"limiter": a.limiter.Stats(),
+		"access": map[string]interface{}{
+			"rules":   a.Rules().Len(),
+			"allowed": a.allowed.Load(),
+			"denied":  a.denied.Load(),
+		},
+	}
+}
+
+func (a *AccessList) GetLimit() int { return a.limiter.GetLimit() }
+
+// check that the access list passes priorities and in flight slots through
+var (
+	_ PriorityAware   = &AccessList{}
+	_ InFlightLimiter = &AccessList{}
+)
@@ -0,0 +1,227 @@
+package limiter
+
+import (
+	"errors"
+	"github.com/vamsaty/cc-rate-limiter/keys"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const accessRules = `
+# health checkers and the office
+allow health-*
+allow 10.0.0.0/8
+allow fd00::/8
+deny re:^scraper-[0-9]+$
+deny 203.0.113.7
+deny mallory
+# denied even from the office
+deny 10.6.6.6
+`
+
+func TestAccessRules(t *testing.T) {
+	rules, err := ParseAccessRules(strings.NewReader(accessRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		subjects []string
+		want     Access
+	}{
+		{[]string{"health-eu"}, AccessAllow},
+		{[]string{"healthy"}, AccessNone},
+		{[]string{"10.1.2.3"}, AccessAllow},
+		{[]string{"10.1.2.3:8080"}, AccessAllow},
+		{[]string{"fd00::1"}, AccessAllow},
+		{[]string{"scraper-42"}, AccessDeny},
+		{[]string{"scraper-x"}, AccessNone},
+		{[]string{"203.0.113.7"}, AccessDeny},
+		{[]string{"mallory"}, AccessDeny},
+		{[]string{"alice", "192.0.2.1"}, AccessNone},
+		// deny takes precedence over allow
+		{[]string{"10.6.6.6"}, AccessDeny},
+		{[]string{"health-eu", "203.0.113.7"}, AccessDeny},
+	} {
+		if got := rules.Match(tc.subjects...); got != tc.want {
+			t.Errorf("%v: expected %s, got %s", tc.subjects, tc.want, got)
+		}
+	}
+
+	for _, invalid := range []string{"permit alice", "deny", "allow re:("} {
+		if _, err := ParseAccessRules(strings.NewReader(invalid)); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestAccessListDecorator(t *testing.T) {
+	rules, _ := ParseAccessRules(strings.NewReader("allow health-*\ndeny mallory"))
+	inner, _ := newFakeClockLimiter(RateConfig{"algo": "token_bucket", "capacity": "1", "refill_rate": "0.001"})
+	limiter := NewAccessList(inner, rules)
+	defer limiter.Stop()
+
+	for i := 0; i < 3; i++ {
+		if err := limiter.Allow("health-eu"); err != nil {
+			t.Fatalf("expected allowed keys to skip the limiter, got %v", err)
+		}
+	}
+	if err := limiter.Allow("mallory"); !errors.Is(err, ErrDenied) {
+		t.Fatalf("expected ErrDenied, got %v", err)
+	}
+	if d := limiter.Decide("alice"); !d.Allowed {
+		t.Fatalf("expected alice's first request to be allowed, got %+v", d)
+	}
+	if d := limiter.Decide("alice"); d.Allowed {
+		t.Fatalf("expected alice's second request to be rate limited, got %+v", d)
+	}
+
+	// the rules can be replaced at runtime
+	rules, _ = ParseAccessRules(strings.NewReader("allow alice"))
+	limiter.SetRules(rules)
+	if err := limiter.Allow("alice"); err != nil {
+		t.Fatalf("expected alice to be allowed by the new rules, got %v", err)
+	}
+}
+
+func TestAccessListDone(t *testing.T) {
+	inner, _ := newFakeClockLimiter(RateConfig{"algo": "concurrency", "max_in_flight": "1"})
+	limiter := NewAccessList(inner, nil)
+	defer limiter.Stop()
+	allow, _ := ParseAccessRules(strings.NewReader("allow alice"))
+
+	// the slot taken is released even if alice got allowed meanwhile
+	if d := limiter.Decide("alice"); !d.Allowed {
+		t.Fatalf("expected alice's first request to be allowed, got %+v", d)
+	}
+	limiter.SetRules(allow)
+	limiter.Done("alice")
+	limiter.SetRules(nil)
+	if d := limiter.Decide("alice"); !d.Allowed {
+		t.Fatalf("expected alice's slot to be released, got %+v", d)
+	}
+
+	// the requests allowed by the rules take no slot, and release none
+	limiter.Done("alice")
+	limiter.SetRules(allow)
+	_ = limiter.Decide("alice")
+	limiter.SetRules(nil)
+	if d := inner.Decide("alice"); !d.Allowed {
+		t.Fatalf("expected alice's slot to be free, got %+v", d)
+	}
+	limiter.Done("alice")
+	if d := inner.Decide("alice"); d.Allowed {
+		t.Fatalf("expected the slot not taken through the access list to be kept, got %+v", d)
+	}
+}
+
+func TestAccessListNothingInFlight(t *testing.T) {
+	inner, _ := newFakeClockLimiter(RateConfig{"algo": "token_bucket", "capacity": "10", "refill_rate": "1", "ban_threshold": "5"})
+	limiter := NewAccessList(inner, nil)
+	defer limiter.Stop()
+
+	// the penalty box releases slots, but the token bucket holds none
+	for _, key := range []string{"alice", "bob", "carol"} {
+		if err := limiter.Allow(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(limiter.inFlight); n != 0 {
+		t.Fatalf("expected no slots to be recorded, got %d keys", n)
+	}
+}
+
+func TestServerAccessRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access")
+	if err := os.WriteFile(path, []byte("allow 192.0.2.0/24"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadAccessRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter, _ := newFakeClockLimiter(RateConfig{"algo": "token_bucket", "capacity": "1", "refill_rate": "0.001"})
+	server := NewServer(limiter)
+	server.SetAccessRules(rules)
+	handler, admin := server.Handler(), server.AdminHandler()
+
+	request := func(handler http.Handler, method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-User", "alice")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	// httptest requests come from 192.0.2.1
+	for i := 0; i < 3; i++ {
+		if code := request(handler, http.MethodGet, "/limited", ""); code != 200 {
+			t.Fatalf("request %d: expected the address to skip the limiter, got %d", i, code)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("deny alice"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if code := request(admin, http.MethodPost, "/access/reload", ""); code != 200 {
+		t.Fatalf("expected the rules to be reloaded, got %d", code)
+	}
+	if code := request(handler, http.MethodGet, "/limited", ""); code != 403 {
+		t.Fatalf("expected alice to be denied, got %d", code)
+	}
+
+	// the rules are only changed through the admin routes
+	if code := request(handler, http.MethodPut, "/access", "allow *"); code != 404 {
+		t.Fatalf("expected the rate limited routes not to change the rules, got %d", code)
+	}
+	if code := request(admin, http.MethodPut, "/access", "allow bob"); code != 200 {
+		t.Fatalf("expected the rules to be replaced, got %d", code)
+	}
+	if got := server.AccessRules().Strings(); len(got) != 1 || got[0] != "allow bob" {
+		t.Fatalf("expected the new rules, got %v", got)
+	}
+	if code := request(handler, http.MethodGet, "/limited", ""); code != 200 {
+		t.Fatalf("expected alice to be rate limited again, got %d", code)
+	}
+	if code := request(admin, http.MethodPost, "/access/reload", ""); code != 400 {
+		t.Fatalf("expected rules not loaded from a file not to be reloaded, got %d", code)
+	}
+	if code := request(admin, http.MethodPut, "/access", "permit bob"); code != 400 {
+		t.Fatalf("expected invalid rules to be refused, got %d", code)
+	}
+}
+
+func TestServerAccessRulesSpoofedIP(t *testing.T) {
+	limiter, _ := newFakeClockLimiter(RateConfig{"algo": "token_bucket", "capacity": "1", "refill_rate": "0.001"})
+	server := NewServer(limiter)
+	rules, _ := ParseAccessRules(strings.NewReader("allow 10.0.0.0/8"))
+	server.SetAccessRules(rules)
+	handler := server.Handler()
+
+	request := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/limited", nil)
+		req.Header.Set("X-User", "alice")
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	// the forwarded address of an untrusted client is ignored
+	for i, want := range []int{200, 429} {
+		if code := request(); code != want {
+			t.Fatalf("request %d: expected %d, got %d", i, want, code)
+		}
+	}
+
+	// httptest requests come from 192.0.2.1
+	clientIP, err := keys.IP("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.ClientIP = clientIP
+	if code := request(); code != 200 {
+		t.Fatalf("expected the address forwarded by a trusted proxy to skip the limiter, got %d", code)
+	}
+}
@@ -0,0 +1,207 @@
+package limiter
+
+/*
+Algorithm: Adaptive (AIMD) token bucket
+A token bucket whose refill rate follows the health of the downstream, using
+additive-increase/multiplicative-decrease. The outcome of every request that
+was let through (its latency and error) is reported back with Feedback. The
+latency is smoothed with an exponentially weighted moving average (EWMA).
+Once per adjust interval the rate is:
+* multiplied by the decrease factor, if a request failed or the smoothed
+  latency is above the target latency
+* increased by a fixed amount, otherwise
+and kept between the min and max rate.
+*/
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// FeedbackLimiter is a RateLimiter that adapts to the outcome of the requests
+// it allowed.
+type FeedbackLimiter interface {
+	RateLimiter
+	// Feedback reports the latency and error (nil on success) of a request
+	Feedback(time.Duration, error)
+}
+
+var (
+	ErrServerError = fmt.Errorf("server error")
+)
+
+// FeedbackOf returns the limiter taking feedback among the limiter and the
+// limiters it wraps, if there is one
+func FeedbackOf(limiter RateLimiter) (FeedbackLimiter, bool) {
+	return unwrap[FeedbackLimiter](limiter)
+}
+
+// StatusError is the error to report as feedback for a response with the
+// HTTP status, nil unless it is a 5xx server error
+func StatusError(status int) error {
+	if status >= 500 {
+		return fmt.Errorf("%w: status %d", ErrServerError, status)
+	}
+	return nil
+}
+
+// AdaptiveLimiter is a token bucket limiter whose refill rate adapts to the
+// feedback about the requests it allowed, satisfying the FeedbackLimiter interface
+type AdaptiveLimiter struct {
+	*TBLimiter
+	config *AdaptiveConfig
+
+	mu sync.Mutex
+	// latency is the smoothed latency, in seconds
+	latency float64
+	// failed is set if a request failed since the last adjustment
+	failed bool
+	// lastAdjust is the time the rate was last adjusted
+	lastAdjust time.Time
+}
+
+// newAdaptiveLimiter wraps the token bucket limiter, starting at its refill rate
+func newAdaptiveLimiter(tbl *TBLimiter, config *AdaptiveConfig) (*AdaptiveLimiter, error) {
+	rate := tbl.RefillRate()
+	if config.MinRate <= 0 || config.MinRate > rate || rate > config.MaxRate {
+		return nil, fmt.Errorf("expected 0 < min_rate <= refill_rate <= max_rate, got %v, %v and %v",
+			config.MinRate, rate, config.MaxRate)
+	}
+	return &AdaptiveLimiter{
+		TBLimiter:  tbl,
+		config:     config,
+		lastAdjust: tbl.clock.Now(),
+	}, nil
+}
+
+// Feedback reports the latency and error (nil on success) of a request that
+// was allowed, adjusting the rate once per adjust interval
+func (a *AdaptiveLimiter) Feedback(latency time.Duration, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.latency == 0 {
+		a.latency = latency.Seconds()
+	} else {
+		a.latency += a.config.Smoothing * (latency.Seconds() - a.latency)
+	}
+	a.failed = a.failed || err != nil
+
+	now := a.clock.Now()
+	if now.Sub(a.lastAdjust) < a.config.AdjustInterval {
+		return
+	}
+	a.adjust(now)
+}
+
+// adjust applies AIMD to the rate, the lock must be held
+func (a *AdaptiveLimiter) adjust(now time.Time) {
+	rate := a.RefillRate()
+	if a.failed || (a.config.TargetLatency > 0 && a.latency > a.config.TargetLatency.Seconds()) {
+		rate *= a.config.Decrease
+	} else {
+		rate += a.config.Increase
+	}
+	rate = math.Max(a.config.MinRate, math.Min(a.config.MaxRate, rate))
+	a.SetRefillRate(rate)
+
+	a.failed, a.lastAdjust = false, now
+}
+
+// Limit returns the current (adapted) refill rate
+func (a *AdaptiveLimiter) Limit() float64 { return a.RefillRate() }
+
+// Stats returns the adapted rate and smoothed latency along with the stats of
+// the buckets
+func (a *AdaptiveLimiter) Stats() interface{} {
+	a.mu.Lock()
+	latency := time.Duration(a.latency * float64(time.Second))
+	a.mu.Unlock()
+
+	return map[string]interface{}{
+		"refill_rate": a.RefillRate(),
+		"min_rate":    a.config.MinRate,
+		"max_rate":    a.config.MaxRate,
+		"latency":     latency,
+		"buckets":     a.TBLimiter.Stats(),
+	}
+}
+
+// AdaptiveConfig is the configuration of the adaptive limiter, on top of the
+// token bucket configuration
+type AdaptiveConfig struct {
+	// MinRate and MaxRate bound the refill rate
+	MinRate float64
+	MaxRate float64
+	// Increase is added to the rate while the downstream is healthy
+	Increase float64
+	// Decrease multiplies the rate once the downstream is unhealthy, in (0, 1)
+	Decrease float64
+	// TargetLatency is the smoothed latency above which the downstream is
+	// unhealthy. 0 means only errors count.
+	TargetLatency time.Duration
+	// Smoothing is the weight of a new latency in the moving average, in (0, 1]
+	Smoothing float64
+	// AdjustInterval is the minimum time between two adjustments of the rate
+	AdjustInterval time.Duration
+}
+
+// Parse parses the args and populates the AdaptiveConfig. The default bounds
+// are 1 (or the refill rate, if lower) and 10 times the refill rate.
+func (ac *AdaptiveConfig) Parse(config RateConfig) error {
+	rate, err := config.float("refill_rate")
+	if err != nil {
+		return err
+	}
+	*ac = AdaptiveConfig{
+		MinRate:        math.Min(1, rate),
+		MaxRate:        10 * rate,
+		Increase:       1,
+		Decrease:       0.5,
+		Smoothing:      0.2,
+		AdjustInterval: time.Second,
+	}
+	floats := map[string]*float64{
+		"min_rate":          &ac.MinRate,
+		"max_rate":          &ac.MaxRate,
+		"rate_increase":     &ac.Increase,
+		"rate_decrease":     &ac.Decrease,
+		"latency_smoothing": &ac.Smoothing,
+	}
+	for key, value := range floats {
+		if config[key] == "" {
+			continue
+		}
+		if *value, err = config.float(key); err != nil {
+			return err
+		}
+	}
+	durations := map[string]*time.Duration{
+		"target_latency":  &ac.TargetLatency,
+		"adjust_interval": &ac.AdjustInterval,
+	}
+	for key, value := range durations {
+		if config[key] == "" {
+			continue
+		}
+		if *value, err = config.duration(key); err != nil {
+			return err
+		}
+	}
+
+	if ac.Increase < 0 {
+		return fmt.Errorf("rate_increase must not be negative, got %v", ac.Increase)
+	}
+	if ac.Decrease <= 0 || ac.Decrease >= 1 {
+		return fmt.Errorf("rate_decrease must be in (0, 1), got %v", ac.Decrease)
+	}
+	if ac.Smoothing <= 0 || ac.Smoothing > 1 {
+		return fmt.Errorf("latency_smoothing must be in (0, 1], got %v", ac.Smoothing)
+	}
+	return nil
+}
+
+// check that the adaptive limiter takes feedback
+var _ FeedbackLimiter = &AdaptiveLimiter{}
@@ -0,0 +1,253 @@
+package limiter
+
+/*
+Algorithm: Concurrency (in-flight) limit
+Instead of limiting the number of requests over time, the number of requests
+being handled at the same time is limited, per client/identity and across all
+of them. Allow takes a slot, which is held until Done is called for the same
+key once the request completes. As it is not known when a slot frees up, the
+RetryAfter of a rejected request is 0.
+*/
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrTooManyInFlight = fmt.Errorf("too many requests in flight")
+)
+
+// InFlightLimiter is a RateLimiter whose allowed requests hold on to their
+// capacity until they are done.
+type InFlightLimiter interface {
+	RateLimiter
+	// Done releases the slot taken by an allowed request
+	Done(string)
+	// DoneN releases the slots taken by an allowed request counting as n requests
+	DoneN(string, int)
+}
+
+// ConcurrencyLimiter limits the number of requests in flight, satisfying the
+// InFlightLimiter interface
+type ConcurrencyLimiter struct {
+	// slots maps userId to its requests in flight. A key is removed as soon
+	// as it has nothing in flight, and keys with requests in flight are never
+	// evicted: new keys are rejected once max_keys keys have some.
+	slots  *keyStore[*inFlight]
+	config *ConcurrencyConfig
+	clock  Clock
+	// global is the number of requests in flight across all keys
+	global atomic.Int64
+}
+
+// Allow takes a slot for a request, if one is free. Done must be called once
+// the request completes.
+func (l *ConcurrencyLimiter) Allow(id string) error {
+	return l.AllowN(id, 1)
+}
+
+// AllowN takes n slots for a request, if they are free. Either all n slots are
+// taken or none are. DoneN must be called once the request completes.
+func (l *ConcurrencyLimiter) AllowN(id string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	if !l.decide(id, n).Allowed {
+		return ErrTooManyInFlight
+	}
+	return nil
+}
+
+// Decide takes a slot for a request, if one is free, and reports the slots
+// left. Done must be called once an allowed request completes.
+func (l *ConcurrencyLimiter) Decide(id string) Decision {
+	return l.decide(id, 1)
+}
+
+// decide takes n slots for the id, if both the key and the global limit allow it
+func (l *ConcurrencyLimiter) decide(id string, n int) Decision {
+	now := l.clock.Now()
+	d := Decision{Limit: l.config.MaxInFlight, ResetAt: now}
+	slot := l.lockSlot(id, now)
+	if slot == nil {
+		return d
+	}
+	defer l.unlockSlot(id, slot, now)
+
+	if slot.count+n <= l.config.MaxInFlight && l.acquireGlobal(n) {
+		slot.count += n
+		d.Allowed = true
+	}
+	d.Remaining = l.config.MaxInFlight - slot.count
+	if l.config.GlobalMaxInFlight > 0 {
+		if global := l.config.GlobalMaxInFlight - int(l.global.Load()); global < d.Remaining {
+			d.Remaining = global
+		}
+	}
+	if d.Remaining < 0 {
+		d.Remaining = 0
+	}
+	if !d.Allowed && n > l.config.MaxInFlight {
+		d.RetryAfter = maxWait
+	}
+	return d
+}
+
+// lockSlot returns the locked in flight count of the id, or nil if max_keys
+// keys already have requests in flight
+func (l *ConcurrencyLimiter) lockSlot(id string, now time.Time) *inFlight {
+	for {
+		slot, ok := l.slots.getIfRoom(id, now)
+		if !ok {
+			return nil
+		}
+		slot.mu.Lock()
+		// the key may have been removed since, its count is not tracked anymore
+		if !slot.removed {
+			return slot
+		}
+		slot.mu.Unlock()
+	}
+}
+
+// unlockSlot unlocks the in flight count of the id, and removes the key if
+// it has nothing in flight
+func (l *ConcurrencyLimiter) unlockSlot(id string, slot *inFlight, now time.Time) {
+	idle := slot.count == 0
+	slot.mu.Unlock()
+	if idle {
+		l.slots.removeIdle(id, now)
+	}
+}
+
+// acquireGlobal takes n slots from the global limit, if they are free
+func (l *ConcurrencyLimiter) acquireGlobal(n int) bool {
+	if l.config.GlobalMaxInFlight <= 0 {
+		l.global.Add(int64(n))
+		return true
+	}
+	for {
+		old := l.global.Load()
+		if old+int64(n) > int64(l.config.GlobalMaxInFlight) {
+			return false
+		}
+		if l.global.CompareAndSwap(old, old+int64(n)) {
+			return true
+		}
+	}
+}
+
+// Done releases the slot taken by an allowed request
+func (l *ConcurrencyLimiter) Done(id string) {
+	l.DoneN(id, 1)
+}
+
+// DoneN releases the n slots taken by an allowed request. Only the slots the
+// key holds are released, none if the key was unregistered or evicted
+// meanwhile (its slots were released then), so extra calls do not free the
+// global slots of other keys.
+func (l *ConcurrencyLimiter) DoneN(id string, n int) {
+	if n <= 0 {
+		return
+	}
+	slot, ok := l.slots.lookup(id)
+	if !ok {
+		return
+	}
+	slot.mu.Lock()
+	if n > slot.count {
+		n = slot.count
+	}
+	slot.count -= n
+	l.global.Add(-int64(n))
+	l.unlockSlot(id, slot, l.clock.Now())
+}
+
+// release releases the global slots of a key removed from the store
+func (l *ConcurrencyLimiter) release(slot *inFlight) {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	l.global.Add(-int64(slot.count))
+	slot.count, slot.removed = 0, true
+}
+
+// newSlot creates the in flight count for the given id
+func (l *ConcurrencyLimiter) newSlot(string) *inFlight {
+	return &inFlight{mu: &sync.Mutex{}, limiter: l}
+}
+
+// Unregister removes the in flight count of the given id
+func (l *ConcurrencyLimiter) Unregister(id string) { l.slots.remove(id) }
+
+// Stop stops the idle key janitor
+func (l *ConcurrencyLimiter) Stop() { l.slots.close() }
+
+// Stats returns a snapshot of the stats for all keys, as of the same time
+func (l *ConcurrencyLimiter) Stats() interface{} {
+	return l.slots.snapshot(l.clock.Now())
+}
+
+func (l *ConcurrencyLimiter) GetLimit() int { return l.config.MaxInFlight }
+
+// ConcurrencyConfig is the configuration for the concurrency limiter
+type ConcurrencyConfig struct {
+	// MaxInFlight is the maximum number of requests in flight per key
+	MaxInFlight int
+	// GlobalMaxInFlight is the maximum number of requests in flight across
+	// all keys. 0 means no limit.
+	GlobalMaxInFlight int
+}
+
+// Parse parses the args and populates the ConcurrencyConfig
+func (cc *ConcurrencyConfig) Parse(config RateConfig) error {
+	var err error
+	if cc.MaxInFlight, err = config.int("max_in_flight"); err != nil {
+		return err
+	}
+
+	if config["global_max_in_flight"] != "" {
+		if cc.GlobalMaxInFlight, err = config.int("global_max_in_flight"); err != nil {
+			return err
+		}
+		if cc.GlobalMaxInFlight < 0 {
+			return fmt.Errorf("global_max_in_flight must not be negative, got %d", cc.GlobalMaxInFlight)
+		}
+	}
+	return nil
+}
+
+// inFlight is the number of requests in flight of a key
+type inFlight struct {
+	mu    *sync.Mutex
+	count int
+	// removed is set once the key is removed from the store
+	removed bool
+	limiter *ConcurrencyLimiter
+}
+
+// stats returns the stats of the key as of now
+func (f *inFlight) stats(now time.Time) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return map[string]interface{}{
+		"in_flight":            f.count,
+		"max_in_flight":        f.limiter.config.MaxInFlight,
+		"global_in_flight":     f.limiter.global.Load(),
+		"global_max_in_flight": f.limiter.config.GlobalMaxInFlight,
+		"current_time":         now,
+	}
+}
+
+// idle reports if the key has no requests in flight
+func (f *inFlight) idle(time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.count == 0
+}
+
+// check that the concurrency limiter releases its slots
+var _ InFlightLimiter = &ConcurrencyLimiter{}
@@ -0,0 +1,431 @@
+package limiter
+
+/*
+Algorithm: Weighted fair queuing (deficit round-robin)
+A global token bucket limits the rate of all requests. A request is allowed
+right away if the bucket has tokens and no request is queued. Otherwise it
+is queued with the other requests of its key and Allow blocks until it is
+dispatched. A dispatcher hands out the tokens as they refill, going over the
+keys with queued requests in turn (deficit round-robin): on its turn a key
+gets its weight added to its deficit and is served while its next request
+costs no more than its deficit. So every key gets a share of the rate in
+proportion to its weight, and a single heavy key can not starve the others.
+Requests are rejected if the queue is full, or once they have waited for
+longer than the max wait.
+*/
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxWait is the time a request waits in the queue at most, unless
+	// configured otherwise
+	DefaultMaxWait = 30 * time.Second
+)
+
+var (
+	ErrMaxWaitExceeded = fmt.Errorf("request waited longer than the max wait")
+	ErrLimiterStopped  = fmt.Errorf("rate limiter is stopped")
+)
+
+// FairQueueLimiter queues the requests over the rate and serves them fairly
+// across keys, satisfying the RateLimiter interface. Keys only have state
+// while they have requests queued.
+type FairQueueLimiter struct {
+	config *FairQueueConfig
+	clock  Clock
+	bucket *tokenBucket
+
+	mu sync.Mutex
+	// queues maps a key to its queued requests
+	queues map[string]*fairQueue
+	// ring holds the *fairQueue of the keys with queued requests, in the
+	// order of their turns
+	ring *list.List
+	// queued is the number of requests waiting, in all queues
+	queued int
+
+	// stopped is set, under mu, once the limiter is stopped. No request is
+	// queued then, as the dispatcher is gone.
+	stopped bool
+	// wake tells the dispatcher a request was queued
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newFairQueueLimiter creates a FairQueueLimiter and starts its dispatcher
+func newFairQueueLimiter(config *FairQueueConfig, clock Clock) *FairQueueLimiter {
+	f := &FairQueueLimiter{
+		config: config,
+		clock:  clock,
+		bucket: newTokenBucket("", &config.TokenBucketConfig, clock.Now()),
+		queues: make(map[string]*fairQueue),
+		ring:   list.New(),
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+	go f.dispatch()
+	return f
+}
+
+// fairRequest is a queued request
+type fairRequest struct {
+	cost int
+	// result receives the outcome once the request is dispatched
+	result chan fairResult
+	// done is set once the request is dispatched or abandoned, guarded by the
+	// limiter's lock
+	done bool
+}
+
+// fairResult is the outcome of a queued request
+type fairResult struct {
+	d   Decision
+	err error
+}
+
+// fairQueue holds the queued requests of a key
+type fairQueue struct {
+	key      string
+	requests []*fairRequest
+	weight   int
+	// deficit is the cost the key may still be served in its turn
+	deficit int
+	// inTurn is set once the weight was added to the deficit for the turn
+	inTurn bool
+	elem   *list.Element
+}
+
+// Allow checks if a request can be allowed, waiting in the queue if required
+func (f *FairQueueLimiter) Allow(id string) error {
+	return f.AllowN(id, 1)
+}
+
+// AllowN checks if a request costing n tokens can be allowed, waiting in the
+// queue if required
+func (f *FairQueueLimiter) AllowN(id string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	_, err := f.decide(id, n)
+	return err
+}
+
+// Decide checks if a request can be allowed, waiting in the queue if required,
+// and reports the state of the bucket
+func (f *FairQueueLimiter) Decide(id string) Decision {
+	d, _ := f.decide(id, 1)
+	return d
+}
+
+// decide allows a request costing n tokens right away, or queues it and waits
+// for it to be dispatched
+func (f *FairQueueLimiter) decide(id string, n int) (Decision, error) {
+	f.mu.Lock()
+	if f.stopped {
+		f.mu.Unlock()
+		return f.rejection(n, maxWait), ErrLimiterStopped
+	}
+	if f.queued == 0 {
+		if d := f.bucket.decide(f.clock.Now(), n); d.Allowed || d.RetryAfter == maxWait {
+			f.mu.Unlock()
+			if !d.Allowed {
+				return d, ErrCannotReserve
+			}
+			return d, nil
+		}
+	}
+	if n > f.config.Capacity {
+		f.mu.Unlock()
+		return f.rejection(n, maxWait), ErrCannotReserve
+	}
+	if f.queued >= f.config.QueueSize {
+		d := f.rejection(n, f.drainTime(n))
+		f.mu.Unlock()
+		return d, ErrQueueFull
+	}
+	r := f.enqueue(id, n)
+	f.mu.Unlock()
+
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if f.config.MaxWait > 0 {
+		timeout = f.clock.After(f.config.MaxWait)
+	}
+	select {
+	case res := <-r.result:
+		return res.d, res.err
+	case <-timeout:
+	}
+
+	f.mu.Lock()
+	if r.done {
+		// dispatched while timing out
+		f.mu.Unlock()
+		res := <-r.result
+		return res.d, res.err
+	}
+	r.done = true
+	f.queued--
+	d := f.rejection(n, f.drainTime(n))
+	f.mu.Unlock()
+	return d, ErrMaxWaitExceeded
+}
+
+// enqueue queues a request of the key, the lock must be held
+func (f *FairQueueLimiter) enqueue(key string, n int) *fairRequest {
+	q := f.queues[key]
+	if q == nil {
+		q = &fairQueue{key: key, weight: f.config.weight(key)}
+		q.elem = f.ring.PushBack(q)
+		f.queues[key] = q
+	}
+	r := &fairRequest{cost: n, result: make(chan fairResult, 1)}
+	q.requests = append(q.requests, r)
+	f.queued++
+	return r
+}
+
+// turn returns the queue whose next request is to be dispatched, by deficit
+// round-robin, or nil if nothing is queued. The request is only popped once
+// dispatched, so calling turn again returns the same queue. The lock must be
+// held.
+func (f *FairQueueLimiter) turn() *fairQueue {
+	for f.ring.Len() > 0 {
+		q := f.ring.Front().Value.(*fairQueue)
+		// skip the requests that gave up waiting
+		for len(q.requests) > 0 && q.requests[0].done {
+			q.requests = q.requests[1:]
+		}
+		if len(q.requests) == 0 {
+			f.removeQueue(q)
+			continue
+		}
+		if !q.inTurn {
+			q.deficit += q.weight
+			q.inTurn = true
+		}
+		if q.requests[0].cost <= q.deficit {
+			return q
+		}
+		// the turn is over, the deficit carries over to the next turn
+		q.inTurn = false
+		f.ring.MoveToBack(q.elem)
+	}
+	return nil
+}
+
+// pop dispatches the next request of the queue, the lock must be held
+func (f *FairQueueLimiter) pop(q *fairQueue, d Decision) {
+	r := q.requests[0]
+	q.requests = q.requests[1:]
+	q.deficit -= r.cost
+	if len(q.requests) == 0 {
+		f.removeQueue(q)
+	}
+	r.done = true
+	f.queued--
+	r.result <- fairResult{d: d}
+}
+
+// removeQueue forgets the queue of a key, the lock must be held
+func (f *FairQueueLimiter) removeQueue(q *fairQueue) {
+	f.ring.Remove(q.elem)
+	delete(f.queues, q.key)
+}
+
+// dispatch hands out the tokens to the queued requests as they refill, until
+// the limiter is stopped
+func (f *FairQueueLimiter) dispatch() {
+	for {
+		f.mu.Lock()
+		q := f.turn()
+		if q == nil {
+			f.mu.Unlock()
+			select {
+			case <-f.wake:
+				continue
+			case <-f.stop:
+				f.drain()
+				return
+			}
+		}
+		d := f.bucket.decide(f.clock.Now(), q.requests[0].cost)
+		if d.Allowed {
+			f.pop(q, d)
+			f.mu.Unlock()
+			continue
+		}
+		f.mu.Unlock()
+
+		select {
+		case <-f.clock.After(d.RetryAfter):
+		case <-f.stop:
+			f.drain()
+			return
+		}
+	}
+}
+
+// drain rejects every queued request, once the limiter is stopped
+func (f *FairQueueLimiter) drain() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, q := range f.queues {
+		for _, r := range q.requests {
+			if !r.done {
+				r.done = true
+				r.result <- fairResult{d: f.rejection(r.cost, maxWait), err: ErrLimiterStopped}
+			}
+		}
+	}
+	f.queues = make(map[string]*fairQueue)
+	f.ring.Init()
+	f.queued = 0
+}
+
+// drainTime estimates the time it takes to serve the queued requests and one
+// costing n, the lock must be held
+func (f *FairQueueLimiter) drainTime(n int) time.Duration {
+	return time.Duration(math.Ceil(float64(f.queued+n) / f.config.RefillRate * float64(time.Second)))
+}
+
+// rejection is the decision for a rejected request
+func (f *FairQueueLimiter) rejection(n int, retryAfter time.Duration) Decision {
+	return Decision{
+		Limit:      f.config.Capacity,
+		ResetAt:    deadline(f.clock.Now(), retryAfter),
+		RetryAfter: retryAfter,
+	}
+}
+
+// Unregister does nothing, keys only have state while they have requests queued
+func (f *FairQueueLimiter) Unregister(string) {}
+
+// Stop stops the dispatcher and rejects the queued requests, and the requests
+// made afterwards
+func (f *FairQueueLimiter) Stop() {
+	f.mu.Lock()
+	f.stopped = true
+	f.mu.Unlock()
+	f.stopOnce.Do(func() { close(f.stop) })
+}
+
+// Stats returns the state of the bucket and the depth of the queues
+func (f *FairQueueLimiter) Stats() interface{} {
+	stats := f.bucket.stats(f.clock.Now())
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make(map[string]interface{}, len(f.queues))
+	for key, q := range f.queues {
+		queued := 0
+		for _, r := range q.requests {
+			if !r.done {
+				queued++
+			}
+		}
+		keys[key] = map[string]interface{}{
+			"queued":  queued,
+			"weight":  q.weight,
+			"deficit": q.deficit,
+		}
+	}
+	stats["queued"] = f.queued
+	stats["queue_size"] = f.config.QueueSize
+	stats["max_wait"] = f.config.MaxWait
+	stats["keys"] = keys
+	return stats
+}
+
+func (f *FairQueueLimiter) GetLimit() int { return f.config.Capacity }
+
+// Window returns the time it takes the empty bucket to refill
+func (f *FairQueueLimiter) Window() time.Duration { return f.config.window() }
+
+// FairQueueConfig is the configuration for the fair queue limiter
+type FairQueueConfig struct {
+	TokenBucketConfig
+	// QueueSize is the maximum number of requests waiting, across all keys
+	QueueSize int
+	// MaxWait is the maximum time a request waits in the queue,
+	// DefaultMaxWait by default. 0 means no limit.
+	MaxWait time.Duration
+	// Weights are the weights of keys, the other keys have DefaultWeight
+	Weights       map[string]int
+	DefaultWeight int
+}
+
+// Parse parses the args and populates the FairQueueConfig. The weights are
+// given as comma separated key=weight pairs, e.g. "alice=3,bob=2".
+func (fc *FairQueueConfig) Parse(config RateConfig) error {
+	if err := fc.TokenBucketConfig.Parse(config); err != nil {
+		return err
+	}
+	if fc.RefillRate <= 0 {
+		return fmt.Errorf("refill_rate must be positive, got %v", fc.RefillRate)
+	}
+
+	var err error
+	fc.QueueSize, fc.MaxWait, fc.DefaultWeight = 100, DefaultMaxWait, 1
+	if config["queue_size"] != "" {
+		if fc.QueueSize, err = config.int("queue_size"); err != nil {
+			return err
+		}
+	}
+	if config["max_wait"] != "" {
+		if fc.MaxWait, err = config.duration("max_wait"); err != nil {
+			return err
+		}
+	}
+	if config["default_weight"] != "" {
+		if fc.DefaultWeight, err = config.int("default_weight"); err != nil {
+			return err
+		}
+	}
+	if fc.DefaultWeight < 1 {
+		return fmt.Errorf("default_weight must be positive, got %d", fc.DefaultWeight)
+	}
+
+	fc.Weights = make(map[string]int)
+	for _, pair := range strings.Split(config["weights"], ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("weights: expected key=weight, got %q", pair)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("weights: the weight of %q must be an integer, got %q", key, value)
+		}
+		if weight < 1 {
+			return fmt.Errorf("weights: the weight of %q must be positive, got %d", key, weight)
+		}
+		fc.Weights[strings.TrimSpace(key)] = weight
+	}
+	return nil
+}
+
+// weight returns the weight of the key
+func (fc *FairQueueConfig) weight(key string) int {
+	if weight, ok := fc.Weights[key]; ok {
+		return weight
+	}
+	return fc.DefaultWeight
+}
@@ -9,8 +9,8 @@ is full.
 */
 
 import (
+	"context"
 	"errors"
-	"strconv"
 	"sync"
 	"time"
 )
@@ -22,55 +22,95 @@ var (
 // WindowLimiterImpl is a fixed window counter implementation for rate limiting.
 // This supports rate limiting per client (or any other criterion)
 type WindowLimiterImpl struct {
-	// windows is a map of windowId to window
-	*sync.Mutex
-	windowMap map[string]*window
-	config    *WindowConfig
+	// windows maps windowId to window
+	windows *keyStore[*window]
+	config  *WindowConfig
+	clock   Clock
 }
 
 // Allow checks if a request can be allowed
 func (w *WindowLimiterImpl) Allow(id string) error {
-	w.Lock()
-	defer w.Unlock()
-
-	fwc := w.windowMap[id]
-	if fwc == nil {
-		fwc = &window{
-			Id:              id,
-			windowSize:      w.config.WindowSize,
-			maxRequestCount: w.config.MaxRequestCount,
-			requestCount:    0,
-			startTime:       time.Now(),
-		}
-		w.windowMap[id] = fwc
+	return w.AllowN(id, 1)
+}
+
+// AllowN checks if a request counting as n requests can be allowed. Either
+// all n requests are counted in the window or none are.
+func (w *WindowLimiterImpl) AllowN(id string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	now := w.clock.Now()
+	return w.window(id, now).allowRequest(now, n)
+}
+
+// Decide checks if a request can be allowed and reports the state of the window
+func (w *WindowLimiterImpl) Decide(id string) Decision {
+	now := w.clock.Now()
+	return w.window(id, now).decide(now, 1)
+}
+
+// Reserve reserves room for a request, see ReserveN
+func (w *WindowLimiterImpl) Reserve(id string) *Reservation {
+	return w.ReserveN(id, 1)
+}
+
+// ReserveN counts n requests in the first window with room for them. The
+// request may proceed once that window has started.
+func (w *WindowLimiterImpl) ReserveN(id string, n int) *Reservation {
+	if n < 0 {
+		return &Reservation{}
+	}
+	return w.window(id, w.clock.Now()).reserve(w.clock, n)
+}
+
+// Wait blocks until there is room for the request in a window
+func (w *WindowLimiterImpl) Wait(ctx context.Context, id string) error {
+	return w.WaitN(ctx, id, 1)
+}
+
+// WaitN blocks until there is room for n requests in a window
+func (w *WindowLimiterImpl) WaitN(ctx context.Context, id string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	return wait(ctx, w.ReserveN(id, n))
+}
+
+// window returns the window for the given id, creating it if required
+func (w *WindowLimiterImpl) window(id string, now time.Time) *window {
+	return w.windows.get(id, now)
+}
+
+// newWindow creates an empty window for the given id
+func (w *WindowLimiterImpl) newWindow(id string) *window {
+	return &window{
+		Id:              id,
+		windowSize:      w.config.WindowSize,
+		maxRequestCount: w.config.MaxRequestCount,
+		requestCount:    0,
+		startTime:       w.clock.Now(),
+		mu:              &sync.Mutex{},
 	}
-	return fwc.allowRequest()
 }
 
 // Unregister removes the window for the given id
 func (w *WindowLimiterImpl) Unregister(s string) {
-	w.Lock()
-	defer w.Unlock()
-	delete(w.windowMap, s)
+	w.windows.remove(s)
 }
 
-func (w *WindowLimiterImpl) Stop() {}
+// Stop stops the idle window janitor
+func (w *WindowLimiterImpl) Stop() { w.windows.close() }
 
-// Stats returns the stats for the window limiter
+// Stats returns a snapshot of the stats for all windows, as of the same time
 func (w *WindowLimiterImpl) Stats() interface{} {
-	data := make(map[string]interface{})
-	for key, fwc := range w.windowMap {
-		data[key] = map[string]interface{}{
-			"size":     fwc.requestCount,
-			"capacity": fwc.maxRequestCount,
-			"interval": fwc.windowSize,
-		}
-	}
-	return data
+	return w.windows.snapshot(w.clock.Now())
 }
 
 func (w *WindowLimiterImpl) GetLimit() int { return w.config.MaxRequestCount }
 
+// Window returns the size of the window
+func (w *WindowLimiterImpl) Window() time.Duration { return w.config.WindowSize }
+
 // WindowConfig is the configuration for a window
 type WindowConfig struct {
 	// WindowSize is the size of the window (interval)
@@ -82,29 +122,29 @@ type WindowConfig struct {
 // Parse parses the args and populates the WindowConfig
 func (wc *WindowConfig) Parse(config map[string]string) error {
 	var err error
-	var value int64
 
 	// parse WindowSize
-	wc.WindowSize, err = time.ParseDuration(config["window_size"])
+	wc.WindowSize, err = RateConfig(config).duration("window_size")
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// parse MaxRequestCount
-	value, err = strconv.ParseInt(config["max_request_count"], 10, 64)
+	wc.MaxRequestCount, err = RateConfig(config).int("max_request_count")
 	if err != nil {
-		panic(err)
+		return err
 	}
-	wc.MaxRequestCount = int(value)
 
 	return nil
 }
 
 // window represents the fixed window counter (per identity - user, ip, etc.)
 type window struct {
+	mu *sync.Mutex
 	// Id is used to identify the entity for which the window is created
 	Id string
-	// requestCount is the total number of requests in the window
+	// requestCount is the total number of requests in the window. Requests
+	// reserved for the following windows are counted beyond maxRequestCount.
 	requestCount int
 	// maxRequestCount specifies the max number of requests allowed in the window
 	maxRequestCount int
@@ -115,22 +155,130 @@ type window struct {
 }
 
 // reset resets the request count and start time
-func (w *window) reset() {
-	if time.Now().Sub(w.startTime) > w.windowSize {
+func (w *window) reset(now time.Time) {
+	// requests reserved beyond the window move into the following window
+	for now.Sub(w.startTime) > w.windowSize && w.requestCount > w.maxRequestCount {
+		w.requestCount -= w.maxRequestCount
+		w.startTime = w.startTime.Add(w.windowSize)
+	}
+	if now.Sub(w.startTime) > w.windowSize {
 		w.requestCount = 0
-		w.startTime = time.Now()
+		w.startTime = now
 	}
 }
 
-// allowRequest checks if a request can be allowed
-func (w *window) allowRequest() error {
+// allowRequest checks if a request counting as n requests can be allowed
+func (w *window) allowRequest(now time.Time, n int) error {
+	if !w.decide(now, n).Allowed {
+		return ErrWindowFull
+	}
+	return nil
+}
+
+// decide counts n requests if they fit in the window and reports the state
+// of the window
+func (w *window) decide(now time.Time, n int) Decision {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	// check window reset
-	w.reset()
+	w.reset(now)
 
 	// check if window is full
-	if w.requestCount >= w.maxRequestCount {
-		return ErrWindowFull
+	if w.requestCount+n > w.maxRequestCount {
+		d := w.decision()
+		d.RetryAfter = w.windowFor(n).Sub(now)
+		if n > w.maxRequestCount {
+			d.RetryAfter = maxWait
+		}
+		return d
 	}
-	w.requestCount++
-	return nil
+	w.requestCount += n
+	d := w.decision()
+	d.Allowed = true
+	return d
+}
+
+// decision reports the state of the window, the lock must be held
+func (w *window) decision() Decision {
+	d := Decision{
+		Limit:     w.maxRequestCount,
+		Remaining: w.maxRequestCount - w.requestCount,
+		ResetAt:   w.windowFor(0).Add(w.windowSize),
+	}
+	if d.Remaining < 0 {
+		d.Remaining = 0
+	}
+	return d
+}
+
+// stats returns the stats of the window as of now
+func (w *window) stats(now time.Time) map[string]interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.reset(now)
+	return map[string]interface{}{
+		"size":     w.requestCount,
+		"capacity": w.maxRequestCount,
+		"interval": w.windowSize,
+	}
+}
+
+// idle reports if the window has passed without requests reserved for the
+// following windows, i.e. the next request starts a new window
+func (w *window) idle(now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.reset(now)
+	return w.requestCount == 0
+}
+
+// reserve counts n requests in the first window with room for them
+func (w *window) reserve(clock Clock, n int) *Reservation {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if n > w.maxRequestCount {
+		return &Reservation{}
+	}
+	w.reset(clock.Now())
+
+	start := w.windowFor(n)
+	w.requestCount += n
+	return &Reservation{
+		ok:        true,
+		timeToAct: start,
+		clock:     clock,
+		cancel:    func(now time.Time) { w.release(now, n, start) },
+		decision:  w.decision(),
+	}
+}
+
+// release uncounts n reserved requests, unless the window starting at
+// start they were counted in has already passed
+func (w *window) release(now time.Time, n int, start time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.reset(now)
+	if !now.Before(start.Add(w.windowSize)) {
+		return
+	}
+	w.requestCount -= n
+	if w.requestCount < 0 {
+		w.requestCount = 0
+	}
+}
+
+// windowFor returns the start of the first window with room for n more
+// requests, after the requests already reserved for the following windows
+func (w *window) windowFor(n int) time.Time {
+	overflow := w.requestCount + n - w.maxRequestCount
+	if overflow <= 0 || w.maxRequestCount <= 0 {
+		return w.startTime
+	}
+	ahead := (overflow + w.maxRequestCount - 1) / w.maxRequestCount
+	return w.startTime.Add(time.Duration(ahead) * w.windowSize)
 }
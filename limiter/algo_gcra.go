@@ -0,0 +1,186 @@
+package limiter
+
+/*
+Algorithm: Generic Cell Rate Algorithm (GCRA)
+GCRA has the same semantics as a token bucket, but instead of a token count
+and a refill time it stores a single value per client/identity: the
+theoretical arrival time (TAT), i.e. the time at which the bucket would be
+full again. With an emission interval T (1/refill rate) and a burst of B:
+
+	newTAT = max(TAT, now) + n*T
+	allow if newTAT - now <= B*T
+
+The TAT is updated with compare-and-swap, so requests for the same key never
+wait on a lock.
+*/
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrRateExceeded = fmt.Errorf("rate exceeded")
+)
+
+// GCRALimiter is a GCRA limiter, satisfying the RateLimiter interface. It is
+// configured like the token bucket, with a capacity (burst) and refill rate.
+type GCRALimiter struct {
+	// cells maps userId to its theoretical arrival time
+	cells  *keyStore[*gcraCell]
+	config *TokenBucketConfig
+	clock  Clock
+	// interval is the emission interval, the time it takes to refill a token
+	interval int64
+	// tolerance is the burst expressed as time, capacity * interval
+	tolerance int64
+}
+
+// newGCRALimiter creates a GCRALimiter. The refill rate must be positive.
+func newGCRALimiter(config *TokenBucketConfig, keyStoreConfig KeyStoreConfig, clock Clock) (*GCRALimiter, error) {
+	if config.RefillRate <= 0 {
+		return nil, fmt.Errorf("refill_rate must be positive for gcra, got %v", config.RefillRate)
+	}
+	interval := int64(math.Ceil(float64(time.Second) / config.RefillRate))
+	g := &GCRALimiter{
+		config:    config,
+		clock:     clock,
+		interval:  interval,
+		tolerance: interval * int64(config.Capacity),
+	}
+	g.cells = newKeyStore(keyStoreConfig, clock, func(string) *gcraCell {
+		return &gcraCell{limiter: g}
+	})
+	return g, nil
+}
+
+// Allow checks if a request can be allowed
+func (g *GCRALimiter) Allow(id string) error {
+	return g.AllowN(id, 1)
+}
+
+// AllowN checks if a request costing n tokens can be allowed. Either all n
+// tokens are taken or none are.
+func (g *GCRALimiter) AllowN(id string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	if !g.decide(id, n).Allowed {
+		return ErrRateExceeded
+	}
+	return nil
+}
+
+// Decide checks if a request can be allowed and reports the state of the key
+func (g *GCRALimiter) Decide(id string) Decision {
+	return g.decide(id, 1)
+}
+
+// decide checks if a request costing n tokens can be allowed for the id
+func (g *GCRALimiter) decide(id string, n int) Decision {
+	now := g.clock.Now()
+	return g.cells.get(id, now).decide(now, n)
+}
+
+// Unregister removes the state of the given id
+func (g *GCRALimiter) Unregister(id string) { g.cells.remove(id) }
+
+// Stop stops the idle key janitor
+func (g *GCRALimiter) Stop() { g.cells.close() }
+
+// Stats returns a snapshot of the stats for all keys, as of the same time
+func (g *GCRALimiter) Stats() interface{} {
+	return g.cells.snapshot(g.clock.Now())
+}
+
+func (g *GCRALimiter) GetLimit() int { return g.config.Capacity }
+
+// Window returns the time it takes to recover the full burst
+func (g *GCRALimiter) Window() time.Duration { return g.config.window() }
+
+// gcraCell holds the theoretical arrival time of a key, in unix nanoseconds
+type gcraCell struct {
+	tat     atomic.Int64
+	limiter *GCRALimiter
+}
+
+// decide moves the TAT forward by n emission intervals if the result stays
+// within the burst tolerance, and reports the state of the cell
+func (c *gcraCell) decide(now time.Time, n int) Decision {
+	g := c.limiter
+	nowNs := now.UnixNano()
+	cost := int64(n) * g.interval
+
+	for {
+		old := c.tat.Load()
+		tat := old
+		if tat < nowNs {
+			tat = nowNs
+		}
+		newTat := tat + cost
+		if newTat-nowNs > g.tolerance {
+			d := c.decision(nowNs, tat)
+			d.RetryAfter = time.Duration(newTat - nowNs - g.tolerance)
+			if n > g.config.Capacity {
+				d.RetryAfter = maxWait
+			}
+			return d
+		}
+		if c.tat.CompareAndSwap(old, newTat) {
+			d := c.decision(nowNs, newTat)
+			d.Allowed = true
+			return d
+		}
+	}
+}
+
+// decision reports the state of the cell with the given TAT
+func (c *gcraCell) decision(nowNs, tat int64) Decision {
+	g := c.limiter
+	if tat < nowNs {
+		tat = nowNs
+	}
+	return Decision{
+		Limit:     g.config.Capacity,
+		Remaining: int((g.tolerance - (tat - nowNs)) / g.interval),
+		ResetAt:   time.Unix(0, tat),
+	}
+}
+
+// stats returns the stats of the cell as of now, the same as a token bucket's,
+// along with the limit (requests per second) and burst of GCRA terms
+func (c *gcraCell) stats(now time.Time) map[string]interface{} {
+	g := c.limiter
+	nowNs := now.UnixNano()
+	ahead := maxInt64(c.tat.Load(), nowNs) - nowNs
+
+	retryAfter := time.Duration(0)
+	if ahead+g.interval > g.tolerance {
+		retryAfter = time.Duration(ahead + g.interval - g.tolerance)
+	}
+	return map[string]interface{}{
+		"tokens":       float64(g.tolerance-ahead) / float64(g.interval),
+		"capacity":     g.config.Capacity,
+		"refill_rate":  g.config.RefillRate,
+		"limit":        g.config.RefillRate,
+		"burst":        g.config.Capacity,
+		"remaining":    int((g.tolerance - ahead) / g.interval),
+		"retry_after":  retryAfter,
+		"tat":          time.Unix(0, nowNs+ahead),
+		"current_time": now,
+	}
+}
+
+// idle reports if the TAT has passed, i.e. the bucket is full again
+func (c *gcraCell) idle(now time.Time) bool {
+	return c.tat.Load() <= now.UnixNano()
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
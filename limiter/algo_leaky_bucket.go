@@ -0,0 +1,296 @@
+package limiter
+
+/*
+Algorithm: Leaky Bucket
+For each client/identity a bucket of a fixed capacity is created, which leaks
+at a constant rate. It runs in one of two modes:
+* meter: every request adds water to the bucket. If the request would make
+  the bucket overflow it is rejected, otherwise it is handled right away.
+* queue: requests are queued in the bucket and released one at a time, at
+  the leak rate. A request is rejected if the queue is full or if it would
+  have to wait longer than the queue timeout. Allow blocks until the request
+  is released, so the output rate is smooth even if the input is bursty.
+*/
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBucketOverflow = fmt.Errorf("bucket is overflowing")
+	ErrQueueFull      = fmt.Errorf("queue is full")
+	ErrQueueTimeout   = fmt.Errorf("request would wait longer than the queue timeout")
+)
+
+const (
+	// LeakyMeter rejects requests that would overflow the bucket
+	LeakyMeter = "meter"
+	// LeakyQueue queues requests and releases them at the leak rate
+	LeakyQueue = "queue"
+)
+
+// LeakyBucketLimiter is a leaky bucket limiter, satisfying the RateLimiter interface
+type LeakyBucketLimiter struct {
+	// buckets maps userId to leaky bucket
+	buckets *keyStore[*leakyBucket]
+	config  *LeakyBucketConfig
+	clock   Clock
+}
+
+// Allow checks if a request can be allowed. In queue mode it blocks until the
+// request is released from the queue.
+func (l *LeakyBucketLimiter) Allow(id string) error {
+	return l.AllowN(id, 1)
+}
+
+// AllowN checks if a request counting as n requests can be allowed. In queue
+// mode it blocks until the request is released from the queue.
+func (l *LeakyBucketLimiter) AllowN(id string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	_, err := l.decide(id, n)
+	return err
+}
+
+// Decide checks if a request can be allowed and reports the state of the
+// bucket. In queue mode it blocks until the request is released from the queue.
+func (l *LeakyBucketLimiter) Decide(id string) Decision {
+	d, _ := l.decide(id, 1)
+	return d
+}
+
+// decide checks if a request counting as n requests can be allowed, waiting
+// for its turn in queue mode
+func (l *LeakyBucketLimiter) decide(id string, n int) (Decision, error) {
+	now := l.clock.Now()
+	d, delay, err := l.buckets.get(id, now).decide(now, n)
+	if err == nil && delay > 0 {
+		<-l.clock.After(delay)
+	}
+	return d, err
+}
+
+// newBucket creates an empty bucket for the given id
+func (l *LeakyBucketLimiter) newBucket(id string) *leakyBucket {
+	return &leakyBucket{
+		mu:       &sync.Mutex{},
+		Id:       id,
+		config:   l.config,
+		lastLeak: l.clock.Now(),
+	}
+}
+
+// Unregister removes the bucket for the given id
+func (l *LeakyBucketLimiter) Unregister(id string) { l.buckets.remove(id) }
+
+// Stop stops the idle bucket janitor
+func (l *LeakyBucketLimiter) Stop() { l.buckets.close() }
+
+// Stats returns a snapshot of the stats for all buckets, as of the same time
+func (l *LeakyBucketLimiter) Stats() interface{} {
+	return l.buckets.snapshot(l.clock.Now())
+}
+
+func (l *LeakyBucketLimiter) GetLimit() int { return l.config.Capacity }
+
+// Window returns the time it takes a full bucket to leak
+func (l *LeakyBucketLimiter) Window() time.Duration {
+	if l.config.LeakRate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(l.config.Capacity) / l.config.LeakRate * float64(time.Second))
+}
+
+// LeakyBucketConfig is the configuration for the leaky bucket
+type LeakyBucketConfig struct {
+	// Capacity is the size of the bucket, i.e. the size of the queue in queue mode
+	Capacity int
+	// LeakRate is the number of requests leaked (released) per second
+	LeakRate float64
+	// Mode is either LeakyMeter or LeakyQueue
+	Mode string
+	// QueueTimeout is the maximum time a request may wait in queue mode.
+	// 0 means requests wait as long as the queue requires.
+	QueueTimeout time.Duration
+}
+
+// Parse parses the args and populates the LeakyBucketConfig
+func (lbc *LeakyBucketConfig) Parse(config RateConfig) error {
+	var err error
+
+	lbc.Capacity, err = config.int("capacity")
+	if err != nil {
+		return err
+	}
+
+	lbc.LeakRate, err = config.float("leak_rate")
+	if err != nil {
+		return err
+	}
+	if lbc.LeakRate <= 0 {
+		return fmt.Errorf("leak_rate must be positive, got %v", lbc.LeakRate)
+	}
+
+	lbc.Mode = config["leaky_mode"]
+	switch lbc.Mode {
+	case "":
+		lbc.Mode = LeakyMeter
+	case LeakyMeter, LeakyQueue:
+	default:
+		return fmt.Errorf("leaky_mode must be %q or %q, got %q", LeakyMeter, LeakyQueue, lbc.Mode)
+	}
+
+	if config["queue_timeout"] != "" {
+		lbc.QueueTimeout, err = config.duration("queue_timeout")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interval returns the time it takes to leak one request
+func (lbc *LeakyBucketConfig) interval() time.Duration {
+	return time.Duration(math.Ceil(float64(time.Second) / lbc.LeakRate))
+}
+
+// leakyBucket is a leaky bucket implementation for rate limiting for each
+// identity/client (user, ip, etc.)
+type leakyBucket struct {
+	mu *sync.Mutex
+	// Id is the id of the user or IP address
+	Id     string
+	config *LeakyBucketConfig
+	// level is the amount of water in the bucket (meter mode)
+	level float64
+	// lastLeak is the time the level was last updated (meter mode)
+	lastLeak time.Time
+	// nextRelease is the time the next queued request is released (queue mode)
+	nextRelease time.Time
+}
+
+// leak removes the water leaked since the last leak (meter mode)
+func (lb *leakyBucket) leak(now time.Time) {
+	elapsed := now.Sub(lb.lastLeak)
+	if elapsed <= 0 {
+		return
+	}
+	lb.level -= elapsed.Seconds() * lb.config.LeakRate
+	if lb.level < 0 {
+		lb.level = 0
+	}
+	lb.lastLeak = now
+}
+
+// queued returns the number of requests waiting in the queue (queue mode)
+func (lb *leakyBucket) queued(now time.Time) int {
+	ahead := lb.nextRelease.Sub(now)
+	if ahead <= 0 {
+		return 0
+	}
+	return int(math.Ceil(float64(ahead) / float64(lb.config.interval())))
+}
+
+// decide admits n requests and returns the time they have to wait before
+// being handled (always 0 in meter mode), or the reason they are rejected
+func (lb *leakyBucket) decide(now time.Time, n int) (Decision, time.Duration, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if lb.config.Mode == LeakyQueue {
+		return lb.enqueue(now, n)
+	}
+
+	lb.leak(now)
+	d := Decision{Limit: lb.config.Capacity}
+	var err error
+	if lb.level+float64(n) > float64(lb.config.Capacity) {
+		err = ErrBucketOverflow
+		d.RetryAfter = maxWait
+		if n <= lb.config.Capacity {
+			excess := lb.level + float64(n) - float64(lb.config.Capacity)
+			d.RetryAfter = time.Duration(math.Ceil(excess / lb.config.LeakRate * float64(time.Second)))
+		}
+	} else {
+		lb.level += float64(n)
+		d.Allowed = true
+	}
+	d.Remaining = int(float64(lb.config.Capacity) - lb.level)
+	d.ResetAt = now.Add(time.Duration(math.Ceil(lb.level / lb.config.LeakRate * float64(time.Second))))
+	return d, 0, err
+}
+
+// enqueue schedules the release of n requests after the ones already queued
+func (lb *leakyBucket) enqueue(now time.Time, n int) (Decision, time.Duration, error) {
+	interval := lb.config.interval()
+	queued := lb.queued(now)
+	d := Decision{Limit: lb.config.Capacity}
+
+	release := lb.nextRelease
+	if release.Before(now) {
+		release = now
+	}
+	delay := release.Sub(now)
+
+	var err error
+	switch {
+	case queued+n > lb.config.Capacity:
+		err = ErrQueueFull
+		d.RetryAfter = maxWait
+		if n <= lb.config.Capacity {
+			d.RetryAfter = time.Duration(queued+n-lb.config.Capacity) * interval
+		}
+	case lb.config.QueueTimeout > 0 && delay > lb.config.QueueTimeout:
+		err = ErrQueueTimeout
+		d.RetryAfter = delay - lb.config.QueueTimeout
+	default:
+		lb.nextRelease = release.Add(time.Duration(n) * interval)
+		queued += n
+		d.Allowed = true
+	}
+	d.Remaining = lb.config.Capacity - queued
+	if d.Remaining < 0 {
+		d.Remaining = 0
+	}
+	d.ResetAt = lb.nextRelease
+	if d.ResetAt.Before(now) {
+		d.ResetAt = now
+	}
+	return d, delay, err
+}
+
+// stats returns the stats of the bucket as of now
+func (lb *leakyBucket) stats(now time.Time) map[string]interface{} {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	data := map[string]interface{}{
+		"capacity":  lb.config.Capacity,
+		"leak_rate": lb.config.LeakRate,
+		"mode":      lb.config.Mode,
+	}
+	if lb.config.Mode == LeakyQueue {
+		data["queued"] = lb.queued(now)
+		data["next_release"] = lb.nextRelease
+	} else {
+		lb.leak(now)
+		data["level"] = lb.level
+	}
+	return data
+}
+
+// idle reports if the bucket is empty as of now
+func (lb *leakyBucket) idle(now time.Time) bool {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if lb.config.Mode == LeakyQueue {
+		return !lb.nextRelease.After(now)
+	}
+	lb.leak(now)
+	return lb.level == 0
+}
@@ -0,0 +1,230 @@
+package limiter
+
+/*
+Algorithm: Priority classes
+A single, global token bucket shared by all requests, of which a fraction of
+the capacity is reserved for the higher priority classes. A request of a class
+may only take tokens if the tokens reserved for the classes above it are left
+in the bucket afterwards:
+
+	critical  : may empty the bucket
+	default   : must leave critical_reserve * capacity tokens
+	sheddable : must leave (critical_reserve + default_reserve) * capacity tokens
+
+So, as the bucket runs low, sheddable requests are rejected first, then
+default ones, and critical requests last.
+*/
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrShed = fmt.Errorf("request shed under load")
+)
+
+// Priority is the priority class of a request
+type Priority int
+
+const (
+	PriorityCritical Priority = iota
+	PriorityDefault
+	PrioritySheddable
+)
+
+// priorities are the priority classes, from the highest
+var priorities = []Priority{PriorityCritical, PriorityDefault, PrioritySheddable}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityCritical:
+		return "critical"
+	case PrioritySheddable:
+		return "sheddable"
+	default:
+		return "default"
+	}
+}
+
+// ParsePriority returns the priority class named s, or PriorityDefault if s is
+// not the name of a class
+func ParsePriority(s string) Priority {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "critical":
+		return PriorityCritical
+	case "sheddable":
+		return PrioritySheddable
+	default:
+		return PriorityDefault
+	}
+}
+
+// PriorityAware is a RateLimiter that takes the priority of requests into account
+type PriorityAware interface {
+	RateLimiter
+	// DecidePriority checks if a request of the priority class can be allowed
+	DecidePriority(string, Priority) Decision
+}
+
+// PriorityLimiter is a global limiter reserving capacity for the higher
+// priority classes, satisfying the PriorityAware interface. The requests of
+// all keys share the same bucket, requests without a priority are of the
+// default class.
+type PriorityLimiter struct {
+	bucket *tokenBucket
+	config *PriorityConfig
+	clock  Clock
+	// admitted and rejected count the requests per priority class
+	admitted [3]atomic.Int64
+	rejected [3]atomic.Int64
+}
+
+// newPriorityLimiter creates a PriorityLimiter with a full bucket
+func newPriorityLimiter(config *PriorityConfig, clock Clock) *PriorityLimiter {
+	return &PriorityLimiter{
+		bucket: newTokenBucket("", &config.TokenBucketConfig, clock.Now()),
+		config: config,
+		clock:  clock,
+	}
+}
+
+// Allow checks if a request of the default class can be allowed
+func (p *PriorityLimiter) Allow(id string) error {
+	return p.AllowN(id, 1)
+}
+
+// AllowN checks if a request of the default class costing n tokens can be allowed
+func (p *PriorityLimiter) AllowN(id string, n int) error {
+	return p.AllowPriorityN(id, PriorityDefault, n)
+}
+
+// AllowPriority checks if a request of the priority class can be allowed
+func (p *PriorityLimiter) AllowPriority(id string, priority Priority) error {
+	return p.AllowPriorityN(id, priority, 1)
+}
+
+// AllowPriorityN checks if a request of the priority class costing n tokens
+// can be allowed
+func (p *PriorityLimiter) AllowPriorityN(_ string, priority Priority, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	if !p.decide(priority, n).Allowed {
+		return ErrShed
+	}
+	return nil
+}
+
+// Decide checks if a request of the default class can be allowed
+func (p *PriorityLimiter) Decide(id string) Decision {
+	return p.DecidePriority(id, PriorityDefault)
+}
+
+// DecidePriority checks if a request of the priority class can be allowed and
+// reports the tokens left to the class
+func (p *PriorityLimiter) DecidePriority(_ string, priority Priority) Decision {
+	return p.decide(priority, 1)
+}
+
+// decide takes n tokens for a request of the priority class, if the tokens
+// reserved for the classes above it are left
+func (p *PriorityLimiter) decide(priority Priority, n int) Decision {
+	if priority < PriorityCritical || priority > PrioritySheddable {
+		priority = PriorityDefault
+	}
+	floor := p.config.floor(priority)
+	d := p.bucket.decideAbove(p.clock.Now(), n, floor)
+	d.Remaining -= int(floor)
+	if d.Remaining < 0 {
+		d.Remaining = 0
+	}
+	if d.Allowed {
+		p.admitted[priority].Add(1)
+	} else {
+		p.rejected[priority].Add(1)
+	}
+	return d
+}
+
+// Unregister does nothing, the bucket is shared by all keys
+func (p *PriorityLimiter) Unregister(string) {}
+
+// Stop does nothing, there is no per-key state to clean up
+func (p *PriorityLimiter) Stop() {}
+
+// Stats returns the state of the bucket and the admitted and rejected
+// requests per priority class
+func (p *PriorityLimiter) Stats() interface{} {
+	stats := p.bucket.stats(p.clock.Now())
+	classes := make(map[string]interface{})
+	for _, priority := range priorities {
+		classes[priority.String()] = map[string]interface{}{
+			"floor":    p.config.floor(priority),
+			"admitted": p.admitted[priority].Load(),
+			"rejected": p.rejected[priority].Load(),
+		}
+	}
+	stats["classes"] = classes
+	return stats
+}
+
+func (p *PriorityLimiter) GetLimit() int { return p.config.Capacity }
+
+// Window returns the time it takes the empty bucket to refill
+func (p *PriorityLimiter) Window() time.Duration { return p.config.window() }
+
+// PriorityConfig is the configuration for the priority limiter
+type PriorityConfig struct {
+	TokenBucketConfig
+	// CriticalReserve is the fraction of the capacity reserved for critical requests
+	CriticalReserve float64
+	// DefaultReserve is the fraction of the capacity reserved for default
+	// (and critical) requests, on top of CriticalReserve
+	DefaultReserve float64
+}
+
+// Parse parses the args and populates the PriorityConfig
+func (pc *PriorityConfig) Parse(config RateConfig) error {
+	if err := pc.TokenBucketConfig.Parse(config); err != nil {
+		return err
+	}
+	pc.CriticalReserve, pc.DefaultReserve = 0.2, 0.3
+	for key, value := range map[string]*float64{
+		"critical_reserve": &pc.CriticalReserve,
+		"default_reserve":  &pc.DefaultReserve,
+	} {
+		if config[key] == "" {
+			continue
+		}
+		var err error
+		if *value, err = config.float(key); err != nil {
+			return err
+		}
+		if *value < 0 {
+			return fmt.Errorf("%s must not be negative, got %v", key, *value)
+		}
+	}
+	if pc.CriticalReserve+pc.DefaultReserve > 1 {
+		return fmt.Errorf("critical_reserve and default_reserve must not add up to more than 1, got %v",
+			pc.CriticalReserve+pc.DefaultReserve)
+	}
+	return nil
+}
+
+// floor returns the tokens a request of the priority class must leave in the bucket
+func (pc *PriorityConfig) floor(priority Priority) float64 {
+	reserve := 0.0
+	if priority >= PriorityDefault {
+		reserve += pc.CriticalReserve
+	}
+	if priority >= PrioritySheddable {
+		reserve += pc.DefaultReserve
+	}
+	return reserve * float64(pc.Capacity)
+}
+
+// check that the priority limiter takes priorities into account
+var _ PriorityAware = &PriorityLimiter{}
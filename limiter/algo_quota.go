@@ -0,0 +1,441 @@
+package limiter
+
+/*
+Algorithm: Quota
+A fixed window counter whose windows are aligned to the calendar (minute,
+hour, day, week or month) in a configurable timezone, instead of starting
+with the first request of a client/identity. Every client gets its quota per
+period and the counts of all clients reset at the same time, e.g. at 00:00 UTC
+on the first day of the month. The quota of a client can be queried, topped
+up for the current period and reset.
+*/
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrQuotaExceeded = fmt.Errorf("quota exceeded")
+	// ErrTooManyQuotas is returned for a new id once max_quotas ids are tracked
+	ErrTooManyQuotas = fmt.Errorf("too many quotas tracked")
+	ErrTopUpTooLarge = fmt.Errorf("top up too large")
+)
+
+const (
+	QuotaMinute = "minute"
+	QuotaHour   = "hour"
+	QuotaDay    = "day"
+	// QuotaWeek periods start on Monday
+	QuotaWeek  = "week"
+	QuotaMonth = "month"
+
+	// DefaultMaxQuotas is the maximum number of ids whose quota is tracked
+	DefaultMaxQuotas = 1000000
+)
+
+// QuotaLimiter is a quota limiter with calendar-aligned periods, satisfying
+// the BlockingRateLimiter interface
+type QuotaLimiter struct {
+	// quotas maps userId to its quota. Forgetting a quota would grant it
+	// again, so quotas are only evicted once idle. The limiter fails closed:
+	// once max_quotas ids are tracked, the new ids are rejected until the
+	// quotas of a past period are evicted.
+	quotas *keyStore[*quota]
+	config *QuotaConfig
+	clock  Clock
+	// rejectedIds counts the requests of new ids rejected as max_quotas ids
+	// were tracked
+	rejectedIds atomic.Int64
+}
+
+// Allow checks if a request can be allowed
+func (q *QuotaLimiter) Allow(id string) error {
+	return q.AllowN(id, 1)
+}
+
+// AllowN checks if a request counting as n requests can be allowed. Either
+// all n requests are counted or none are.
+func (q *QuotaLimiter) AllowN(id string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	now := q.clock.Now()
+	quota, ok := q.quota(id, now)
+	if !ok {
+		return ErrTooManyQuotas
+	}
+	if !quota.decide(now, n).Allowed {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Decide checks if a request can be allowed and reports the state of the quota
+func (q *QuotaLimiter) Decide(id string) Decision {
+	now := q.clock.Now()
+	quota, ok := q.quota(id, now)
+	if !ok {
+		// quotas of the current period become idle once it is over
+		resetAt := q.config.periodAfter(q.config.periodStart(now))
+		return Decision{Limit: q.config.Quota, ResetAt: resetAt, RetryAfter: resetAt.Sub(now)}
+	}
+	return quota.decide(now, 1)
+}
+
+// Reserve reserves quota for a request, see ReserveN
+func (q *QuotaLimiter) Reserve(id string) *Reservation {
+	return q.ReserveN(id, 1)
+}
+
+// ReserveN counts n requests in the first period with quota left for them.
+// The request may proceed once that period has started.
+func (q *QuotaLimiter) ReserveN(id string, n int) *Reservation {
+	if n < 0 {
+		return &Reservation{}
+	}
+	quota, ok := q.quota(id, q.clock.Now())
+	if !ok {
+		return &Reservation{}
+	}
+	return quota.reserve(q.clock, n)
+}
+
+// Wait blocks until there is quota left for the request
+func (q *QuotaLimiter) Wait(ctx context.Context, id string) error {
+	return q.WaitN(ctx, id, 1)
+}
+
+// WaitN blocks until there is quota left for n requests
+func (q *QuotaLimiter) WaitN(ctx context.Context, id string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	return wait(ctx, q.ReserveN(id, n))
+}
+
+// Remaining returns the number of requests the id can still make in the
+// current period
+func (q *QuotaLimiter) Remaining(id string) int {
+	quota, ok := q.quotas.lookup(id)
+	if !ok {
+		return q.config.Quota
+	}
+	return quota.remaining(q.clock.Now())
+}
+
+// TopUp grants the id n more requests for the current period
+func (q *QuotaLimiter) TopUp(id string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	now := q.clock.Now()
+	quota, ok := q.quota(id, now)
+	if !ok {
+		return ErrTooManyQuotas
+	}
+	return quota.topUp(now, n)
+}
+
+// quota returns the quota of the id, creating it unless max_quotas ids are
+// tracked already
+func (q *QuotaLimiter) quota(id string, now time.Time) (*quota, bool) {
+	quota, ok := q.quotas.getIfRoom(id, now)
+	if !ok {
+		q.rejectedIds.Add(1)
+	}
+	return quota, ok
+}
+
+// Reset gives the id its full quota back, dropping its top ups
+func (q *QuotaLimiter) Reset(id string) { q.quotas.remove(id) }
+
+// newQuota creates an unused quota for the given id
+func (q *QuotaLimiter) newQuota(id string) *quota {
+	return &quota{
+		mu:     &sync.Mutex{},
+		Id:     id,
+		config: q.config,
+		start:  q.config.periodStart(q.clock.Now()),
+	}
+}
+
+// Unregister removes the quota of the given id
+func (q *QuotaLimiter) Unregister(id string) { q.quotas.remove(id) }
+
+// Stop stops the idle quota janitor
+func (q *QuotaLimiter) Stop() { q.quotas.close() }
+
+// Stats returns a snapshot of the stats for all quotas, as of the same time,
+// and how many of max_quotas are tracked
+func (q *QuotaLimiter) Stats() interface{} {
+	return map[string]interface{}{
+		"quotas":       q.quotas.snapshot(q.clock.Now()),
+		"tracked":      q.quotas.len(),
+		"max_quotas":   q.config.MaxQuotas,
+		"rejected_ids": q.rejectedIds.Load(),
+	}
+}
+
+func (q *QuotaLimiter) GetLimit() int { return q.config.Quota }
+
+// Window returns the length of the current period
+func (q *QuotaLimiter) Window() time.Duration {
+	start := q.config.periodStart(q.clock.Now())
+	return q.config.periodAfter(start).Sub(start)
+}
+
+// QuotaConfig is the configuration for the quota
+type QuotaConfig struct {
+	// Quota is the number of requests allowed per period
+	Quota int
+	// Period is one of QuotaMinute, QuotaHour, QuotaDay, QuotaWeek or QuotaMonth
+	Period string
+	// Location is the timezone the periods are aligned in
+	Location *time.Location
+	// MaxQuotas is the maximum number of ids tracked, DefaultMaxQuotas by
+	// default. 0 means no limit.
+	MaxQuotas int
+}
+
+// Parse parses the args and populates the QuotaConfig
+func (qc *QuotaConfig) Parse(config RateConfig) error {
+	var err error
+	if qc.Quota, err = config.int("quota"); err != nil {
+		return err
+	}
+
+	qc.Period = config["quota_period"]
+	switch qc.Period {
+	case QuotaMinute, QuotaHour, QuotaDay, QuotaWeek, QuotaMonth:
+	default:
+		return fmt.Errorf("quota_period must be minute, hour, day, week or month, got %q", qc.Period)
+	}
+
+	qc.Location = time.UTC
+	if tz := config["timezone"]; tz != "" {
+		qc.Location, err = time.LoadLocation(tz)
+		if err != nil {
+			return err
+		}
+	}
+
+	qc.MaxQuotas = DefaultMaxQuotas
+	if config["max_quotas"] != "" {
+		if qc.MaxQuotas, err = config.int("max_quotas"); err != nil {
+			return err
+		}
+		if qc.MaxQuotas < 0 {
+			return fmt.Errorf("max_quotas must not be negative, got %d", qc.MaxQuotas)
+		}
+	}
+	return nil
+}
+
+// periodStart returns the start of the period t is in
+func (qc *QuotaConfig) periodStart(t time.Time) time.Time {
+	t = t.In(qc.Location)
+	year, month, day := t.Date()
+	switch qc.Period {
+	case QuotaMinute:
+		return time.Date(year, month, day, t.Hour(), t.Minute(), 0, 0, qc.Location)
+	case QuotaHour:
+		return time.Date(year, month, day, t.Hour(), 0, 0, 0, qc.Location)
+	case QuotaWeek:
+		// days since Monday
+		day -= (int(t.Weekday()) + 6) % 7
+	case QuotaMonth:
+		day = 1
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, qc.Location)
+}
+
+// periodAfter returns the start of the period after the one starting at start
+func (qc *QuotaConfig) periodAfter(start time.Time) time.Time {
+	switch qc.Period {
+	case QuotaMinute:
+		return start.Add(time.Minute)
+	case QuotaHour:
+		return start.Add(time.Hour)
+	case QuotaDay:
+		return start.AddDate(0, 0, 1)
+	case QuotaWeek:
+		return start.AddDate(0, 0, 7)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
+
+// quota is the quota of an identity/client (user, ip, etc.)
+type quota struct {
+	mu *sync.Mutex
+	// Id is the id of the user or IP address
+	Id     string
+	config *QuotaConfig
+	// used is the number of requests counted in the current period. It
+	// exceeds the limit if requests are reserved for the following periods.
+	used int
+	// bonus is the quota topped up for the current period
+	bonus int
+	// start is the start of the current period
+	start time.Time
+}
+
+// limit returns the number of requests allowed in the current period
+func (q *quota) limit() int { return q.config.Quota + q.bonus }
+
+// roll moves to the period now is in. Requests reserved beyond the current
+// period move into the following period.
+func (q *quota) roll(now time.Time) {
+	for !now.Before(q.config.periodAfter(q.start)) {
+		if q.used <= q.limit() {
+			q.used, q.bonus, q.start = 0, 0, q.config.periodStart(now)
+			return
+		}
+		q.used -= q.limit()
+		q.bonus = 0
+		q.start = q.config.periodAfter(q.start)
+	}
+}
+
+// decide counts n requests if there is quota left for them and reports the
+// state of the quota
+func (q *quota) decide(now time.Time, n int) Decision {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.roll(now)
+	if q.used+n > q.limit() {
+		d := q.decision()
+		d.RetryAfter = q.periodFor(n).Sub(now)
+		// top ups do not carry over, later periods only have the quota
+		if n > q.config.Quota {
+			d.RetryAfter = maxWait
+		}
+		return d
+	}
+	q.used += n
+	d := q.decision()
+	d.Allowed = true
+	return d
+}
+
+// decision reports the state of the quota, the lock must be held
+func (q *quota) decision() Decision {
+	d := Decision{
+		Limit:     q.limit(),
+		Remaining: q.limit() - q.used,
+		ResetAt:   q.config.periodAfter(q.start),
+	}
+	if d.Remaining < 0 {
+		d.Remaining = 0
+	}
+	return d
+}
+
+// remaining returns the number of requests left in the current period
+func (q *quota) remaining(now time.Time) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.roll(now)
+	return q.decision().Remaining
+}
+
+// topUp grants n more requests for the current period, unless the limit
+// would overflow
+func (q *quota) topUp(now time.Time, n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.roll(now)
+	if n > math.MaxInt-q.limit() {
+		return ErrTopUpTooLarge
+	}
+	q.bonus += n
+	return nil
+}
+
+// reserve counts n requests in the first period with quota left for them
+func (q *quota) reserve(clock Clock, n int) *Reservation {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := clock.Now()
+	q.roll(now)
+	if q.used+n > q.limit() && n > q.config.Quota {
+		return &Reservation{}
+	}
+
+	start := q.periodFor(n)
+	q.used += n
+	return &Reservation{
+		ok:        true,
+		timeToAct: start,
+		clock:     clock,
+		cancel:    func(now time.Time) { q.release(now, n, start) },
+		decision:  q.decision(),
+	}
+}
+
+// release uncounts n reserved requests, unless the period starting at start
+// they were counted in has already passed
+func (q *quota) release(now time.Time, n int, start time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.roll(now)
+	if !now.Before(q.config.periodAfter(start)) {
+		return
+	}
+	q.used -= n
+	if q.used < 0 {
+		q.used = 0
+	}
+}
+
+// periodFor returns the start of the first period with quota left for n more
+// requests, after the requests already reserved for the following periods.
+// The lock must be held.
+func (q *quota) periodFor(n int) time.Time {
+	overflow := q.used + n - q.limit()
+	start := q.start
+	if overflow <= 0 || q.config.Quota <= 0 {
+		return start
+	}
+	for ahead := (overflow + q.config.Quota - 1) / q.config.Quota; ahead > 0; ahead-- {
+		start = q.config.periodAfter(start)
+	}
+	return start
+}
+
+// stats returns the stats of the quota as of now
+func (q *quota) stats(now time.Time) map[string]interface{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.roll(now)
+	return map[string]interface{}{
+		"used":         q.used,
+		"quota":        q.config.Quota,
+		"top_up":       q.bonus,
+		"remaining":    q.decision().Remaining,
+		"period":       q.config.Period,
+		"period_start": q.start,
+		"reset_at":     q.config.periodAfter(q.start),
+	}
+}
+
+// idle reports if nothing is counted or topped up in the current period, so
+// a quota used in a period is kept at least until the period ends
+func (q *quota) idle(now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.roll(now)
+	return q.used == 0 && q.bonus == 0
+}
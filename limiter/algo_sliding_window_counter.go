@@ -1,27 +1,255 @@
 package limiter
 
+/*
+Algorithm: Sliding Window Counter
+Time is divided into fixed windows (aligned to multiples of the window size).
+For each client/identity only the request counts of the current and the
+previous window are stored. The number of requests in the sliding window
+ending now is estimated by weighting the previous window's count with the
+fraction of it that still overlaps the sliding window:
+
+	estimate = previousCount * (1 - elapsed/windowLen) + currentCount
+
+Reject the request if the estimate has reached the limit. Otherwise, handle
+the request and increment the current window's count.
+*/
+
 import (
 	"fmt"
+	"math"
+	"sync"
 	"time"
 )
 
-// TODO: implement sliding window counter algorithm
-
 var (
 	ErrTooManyRequests = fmt.Errorf("too many requests")
 )
 
+// SlidingWindowCounterLimiter satisfies the RateLimiter interface.
+// This is used to support rate limiting per client (or other criterion)
+type SlidingWindowCounterLimiter struct {
+	// counters maps userId to sliding window counter
+	counters *keyStore[*slidingWindowCounter]
+	config   *SlidingWindowCounterConfig
+	clock    Clock
+}
+
+// Allow checks if a request can be allowed
+func (s *SlidingWindowCounterLimiter) Allow(id string) error {
+	return s.AllowN(id, 1)
+}
+
+// AllowN checks if a request counting as n requests can be allowed. Either
+// all n requests are counted or none are.
+func (s *SlidingWindowCounterLimiter) AllowN(id string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	now := s.clock.Now()
+	return s.counter(id, now).allowRequest(now, n)
+}
+
+// Decide checks if a request can be allowed and reports the state of the counter
+func (s *SlidingWindowCounterLimiter) Decide(id string) Decision {
+	now := s.clock.Now()
+	return s.counter(id, now).decide(now, 1)
+}
+
+// counter returns the counter for the given id, creating it if required
+func (s *SlidingWindowCounterLimiter) counter(id string, now time.Time) *slidingWindowCounter {
+	return s.counters.get(id, now)
+}
+
+// newCounter creates an empty counter for the given id
+func (s *SlidingWindowCounterLimiter) newCounter(id string) *slidingWindowCounter {
+	return &slidingWindowCounter{
+		Id:                  id,
+		maxRequestPerWindow: s.config.MaxRequestCount,
+		windowLen:           s.config.WindowSize,
+		mu:                  &sync.Mutex{},
+	}
+}
+
+// Unregister removes the counter for the given id
+func (s *SlidingWindowCounterLimiter) Unregister(id string) {
+	s.counters.remove(id)
+}
+
+// Stop stops the idle counter janitor
+func (s *SlidingWindowCounterLimiter) Stop() { s.counters.close() }
+
+// Stats returns a snapshot of the stats for all counters, as of the same time
+func (s *SlidingWindowCounterLimiter) Stats() interface{} {
+	return s.counters.snapshot(s.clock.Now())
+}
+
+func (s *SlidingWindowCounterLimiter) GetLimit() int { return s.config.MaxRequestCount }
+
+// Window returns the size of the window
+func (s *SlidingWindowCounterLimiter) Window() time.Duration { return s.config.WindowSize }
+
+// SlidingWindowCounterConfig is the configuration for the sliding window counter
+type SlidingWindowCounterConfig struct {
+	// WindowSize is the size of the window (interval)
+	WindowSize time.Duration
+	// MaxRequestCount is the maximum number of requests allowed in a sliding window
+	MaxRequestCount int
+}
+
+// Parse parses the args and populates the SlidingWindowCounterConfig
+func (swcc *SlidingWindowCounterConfig) Parse(config RateConfig) error {
+	var err error
+
+	swcc.WindowSize, err = config.duration("window_size")
+	if err != nil {
+		return err
+	}
+	if swcc.WindowSize <= 0 {
+		return fmt.Errorf("window_size must be positive, got %s", swcc.WindowSize)
+	}
+
+	swcc.MaxRequestCount, err = config.int("max_request_count")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// slidingWindowCounter is a sliding window counter implementation for rate
+// limiting for each identity/client (user, ip, etc.)
 type slidingWindowCounter struct {
+	mu *sync.Mutex
+	// Id is the id of the user or IP address
+	Id string
+	// maxRequestPerWindow is the maximum number of requests allowed in a sliding window
 	maxRequestPerWindow int
 	// windowLen is size of the sliding window
-	windowLen     time.Duration
+	windowLen time.Duration
+	// windowStart is the start time of the current (fixed) window
+	windowStart time.Time
+	// previousCount is the number of requests in the previous window
 	previousCount int
-	currentCount  int
+	// currentCount is the number of requests in the current window
+	currentCount int
+}
+
+// rotate moves the counters forward so that windowStart is the start of the
+// window containing now
+func (swc *slidingWindowCounter) rotate(now time.Time) {
+	start := now.Truncate(swc.windowLen)
+	if !start.After(swc.windowStart) {
+		return
+	}
+	if start.Sub(swc.windowStart) == swc.windowLen {
+		// the current window becomes the previous window
+		swc.previousCount = swc.currentCount
+	} else {
+		// more than one window has passed without requests
+		swc.previousCount = 0
+	}
+	swc.currentCount = 0
+	swc.windowStart = start
+}
+
+// estimate returns the weighted number of requests in the sliding window
+// ending at now. It does not modify the counters.
+func (swc *slidingWindowCounter) estimate(now time.Time) float64 {
+	start := now.Truncate(swc.windowLen)
+	previous, current := swc.previousCount, swc.currentCount
+	if start.After(swc.windowStart) {
+		if start.Sub(swc.windowStart) == swc.windowLen {
+			previous = current
+		} else {
+			previous = 0
+		}
+		current = 0
+	}
+	weight := 1 - float64(now.Sub(start))/float64(swc.windowLen)
+	return float64(previous)*weight + float64(current)
+}
+
+// stats returns the stats of the counter as of now
+func (swc *slidingWindowCounter) stats(now time.Time) map[string]interface{} {
+	swc.mu.Lock()
+	defer swc.mu.Unlock()
+
+	swc.rotate(now)
+	return map[string]interface{}{
+		"previous_count": swc.previousCount,
+		"current_count":  swc.currentCount,
+		"estimate":       swc.estimate(now),
+		"capacity":       swc.maxRequestPerWindow,
+		"interval":       swc.windowLen,
+		"window_start":   swc.windowStart,
+	}
 }
 
-func (swc *slidingWindowCounter) allowRequest() error {
-	if swc.currentCount >= swc.maxRequestPerWindow {
+// idle reports if the estimate has dropped to 0 as of now
+func (swc *slidingWindowCounter) idle(now time.Time) bool {
+	swc.mu.Lock()
+	defer swc.mu.Unlock()
+
+	return swc.estimate(now) <= 0
+}
+
+// allowRequest returns an error if n requests exceed the rate limit otherwise nil
+func (swc *slidingWindowCounter) allowRequest(now time.Time, n int) error {
+	if !swc.decide(now, n).Allowed {
 		return ErrTooManyRequests
 	}
 	return nil
 }
+
+// decide counts n requests if the estimate leaves room for them and reports
+// the state of the counter
+func (swc *slidingWindowCounter) decide(now time.Time, n int) Decision {
+	swc.mu.Lock()
+	defer swc.mu.Unlock()
+
+	swc.rotate(now)
+
+	d := Decision{Limit: swc.maxRequestPerWindow}
+	if swc.estimate(now)+float64(n) > float64(swc.maxRequestPerWindow) {
+		d.RetryAfter = swc.timeUntilAdmit(now, n)
+	} else {
+		swc.currentCount += n
+		d.Allowed = true
+	}
+	d.Remaining = int(float64(swc.maxRequestPerWindow) - swc.estimate(now))
+	if d.Remaining < 0 {
+		d.Remaining = 0
+	}
+	// the estimate drops to 0 once the last counted request is two windows old
+	switch {
+	case swc.currentCount > 0:
+		d.ResetAt = swc.windowStart.Add(2 * swc.windowLen)
+	case swc.previousCount > 0:
+		d.ResetAt = swc.windowStart.Add(swc.windowLen)
+	default:
+		d.ResetAt = now
+	}
+	return d
+}
+
+// timeUntilAdmit returns the time after which the estimate leaves room for
+// n more requests. The counters must already be rotated to now.
+func (swc *slidingWindowCounter) timeUntilAdmit(now time.Time, n int) time.Duration {
+	limit := float64(swc.maxRequestPerWindow)
+	if n > swc.maxRequestPerWindow {
+		return maxWait
+	}
+	// weighted count that may remain from the window preceding the one the
+	// request lands in, and the start of that window
+	carried, start := float64(swc.previousCount), swc.windowStart
+	room := limit - float64(n) - float64(swc.currentCount)
+	if room < 0 {
+		// the current window alone is full, wait for the next window
+		carried, start, room = float64(swc.currentCount), start.Add(swc.windowLen), limit-float64(n)
+	}
+	if carried <= room {
+		return start.Sub(now)
+	}
+	// carried * (1 - elapsed/windowLen) <= room
+	elapsed := time.Duration(math.Ceil((1 - room/carried) * float64(swc.windowLen)))
+	return start.Add(elapsed).Sub(now)
+}
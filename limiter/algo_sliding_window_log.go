@@ -10,9 +10,9 @@ Use a heap to store the requests.
 
 import (
 	"container/heap"
+	"context"
 	"fmt"
 	"sort"
-	"strconv"
 	"sync"
 	"time"
 )
@@ -25,43 +25,88 @@ var (
 // This is used to support rate limiting per client (or other criterion)
 type SlidingWindowLogRateLimiter struct {
 	config *SlidingWindowLogConfig
-	swMap  map[string]*slidingWindowLog
+	logs   *keyStore[*slidingWindowLog]
+	clock  Clock
 }
 
 // Allow returns nil if the request is allowed, otherwise returns an error
 func (s *SlidingWindowLogRateLimiter) Allow(id string) error {
-	swl := s.swMap[id]
-	if swl == nil {
-		swl = &slidingWindowLog{
-			Id:              id,
-			windowSize:      s.config.windowLen,
-			maxRequestCount: s.config.requestPerSec * int(s.config.windowLen.Seconds()),
-			requestHeap:     newRequestHeap(),
-			mu:              &sync.Mutex{},
-		}
-		s.swMap[id] = swl
+	return s.AllowN(id, 1)
+}
+
+// AllowN returns nil if a request counting as n requests is allowed,
+// otherwise returns an error. Either all n requests are logged or none are.
+func (s *SlidingWindowLogRateLimiter) AllowN(id string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	now := s.clock.Now()
+	return s.log(id, now).allowRequest(now, n)
+}
+
+// Decide checks if a request can be allowed and reports the state of the log
+func (s *SlidingWindowLogRateLimiter) Decide(id string) Decision {
+	now := s.clock.Now()
+	return s.log(id, now).decide(now, 1)
+}
+
+// Reserve reserves room in the window for a request, see ReserveN
+func (s *SlidingWindowLogRateLimiter) Reserve(id string) *Reservation {
+	return s.ReserveN(id, 1)
+}
+
+// ReserveN logs n requests at the earliest time there is room for them in
+// the window. The request may proceed at that time.
+func (s *SlidingWindowLogRateLimiter) ReserveN(id string, n int) *Reservation {
+	if n < 0 {
+		return &Reservation{}
+	}
+	return s.log(id, s.clock.Now()).reserve(s.clock, n)
+}
+
+// Wait blocks until there is room for the request in the window
+func (s *SlidingWindowLogRateLimiter) Wait(ctx context.Context, id string) error {
+	return s.WaitN(ctx, id, 1)
+}
+
+// WaitN blocks until there is room for n requests in the window
+func (s *SlidingWindowLogRateLimiter) WaitN(ctx context.Context, id string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	return wait(ctx, s.ReserveN(id, n))
+}
+
+// log returns the sliding window log for the given id, creating it if required
+func (s *SlidingWindowLogRateLimiter) log(id string, now time.Time) *slidingWindowLog {
+	return s.logs.get(id, now)
+}
+
+// newLog creates an empty sliding window log for the given id
+func (s *SlidingWindowLogRateLimiter) newLog(id string) *slidingWindowLog {
+	return &slidingWindowLog{
+		Id:              id,
+		windowSize:      s.config.windowLen,
+		maxRequestCount: s.GetLimit(),
+		requestHeap:     newRequestHeap(),
+		mu:              &sync.Mutex{},
 	}
-	return swl.allowRequest()
 }
 
 func (s *SlidingWindowLogRateLimiter) GetLimit() int {
 	return s.config.requestPerSec * int(s.config.windowLen.Seconds())
 }
 
-func (s *SlidingWindowLogRateLimiter) Unregister(s2 string) { delete(s.swMap, s2) }
+// Window returns the size of the window
+func (s *SlidingWindowLogRateLimiter) Window() time.Duration { return s.config.windowLen }
+
+func (s *SlidingWindowLogRateLimiter) Unregister(s2 string) { s.logs.remove(s2) }
 
-func (s *SlidingWindowLogRateLimiter) Stop() {}
+func (s *SlidingWindowLogRateLimiter) Stop() { s.logs.close() }
 
+// Stats returns a snapshot of the stats for all logs, as of the same time
 func (s *SlidingWindowLogRateLimiter) Stats() interface{} {
-	data := make(map[string]interface{})
-	for key, fwc := range s.swMap {
-		data[key] = map[string]interface{}{
-			"request_count": fwc.requestHeap.Len(),
-			"capacity":      fwc.maxRequestCount,
-			"interval":      fwc.windowSize,
-		}
-	}
-	return data
+	return s.logs.snapshot(s.clock.Now())
 }
 
 // requestLog is an entry in the sliding window log
@@ -118,13 +163,13 @@ type SlidingWindowLogConfig struct {
 
 // Parse parses the args and stores the values in SlidingWindowLogConfig
 func (swlc *SlidingWindowLogConfig) Parse(config RateConfig) error {
-	limit, err := strconv.ParseInt(config["request_per_sec"], 10, 32)
+	var err error
+	swlc.requestPerSec, err = config.int("request_per_sec")
 	if err != nil {
 		return err
 	}
-	swlc.requestPerSec = int(limit)
 
-	swlc.windowLen, err = time.ParseDuration(config["window_size"])
+	swlc.windowLen, err = config.duration("window_size")
 	if err != nil {
 		return err
 	}
@@ -146,29 +191,144 @@ type slidingWindowLog struct {
 }
 
 // cleanup removes requests that fall out of the window
-func (s *slidingWindowLog) cleanup() {
-	startTime := time.Now().Add(-s.windowSize)
+func (s *slidingWindowLog) cleanup(now time.Time) {
+	startTime := now.Add(-s.windowSize)
 	for s.Len() > 0 {
 		if s.Peek().timestamp.After(startTime) {
 			break
 		}
 		// remove the requests outside the window
-		s.Pop()
+		heap.Pop(s.requestHeap)
 	}
 }
 
-// allowRequest returns an error if rate limit is reached otherwise nil
-func (s *slidingWindowLog) allowRequest() error {
+// allowRequest returns an error if n requests do not fit in the window otherwise nil
+func (s *slidingWindowLog) allowRequest(now time.Time, n int) error {
+	if !s.decide(now, n).Allowed {
+		return ErrLimitExceeded
+	}
+	return nil
+}
+
+// decide logs n requests if there is room for them in the window and reports
+// the state of the log. Rejected requests are not logged, so they do not
+// extend the time a client has to wait.
+func (s *slidingWindowLog) decide(now time.Time, n int) Decision {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// submit the request
-	s.requestHeap.Push(requestLog{
-		timestamp: time.Now(),
-	})
-	s.cleanup()
-	if s.Len() > s.maxRequestCount {
-		return ErrLimitExceeded
+	s.cleanup(now)
+
+	if s.Len()+n > s.maxRequestCount {
+		d := s.decision(now)
+		d.RetryAfter = maxWait
+		if n <= s.maxRequestCount {
+			d.RetryAfter = s.timeToFit(n).Sub(now)
+		}
+		return d
 	}
-	return nil
+	// submit the requests
+	for i := 0; i < n; i++ {
+		heap.Push(s.requestHeap, requestLog{timestamp: now})
+	}
+	d := s.decision(now)
+	d.Allowed = true
+	return d
+}
+
+// decision reports the state of the log, the lock must be held
+func (s *slidingWindowLog) decision(now time.Time) Decision {
+	d := Decision{
+		Limit:     s.maxRequestCount,
+		Remaining: s.maxRequestCount - s.Len(),
+		ResetAt:   now,
+	}
+	if d.Remaining < 0 {
+		d.Remaining = 0
+	}
+	for _, r := range s.requests {
+		if end := r.timestamp.Add(s.windowSize); end.After(d.ResetAt) {
+			d.ResetAt = end
+		}
+	}
+	return d
+}
+
+// stats returns the stats of the log as of now
+func (s *slidingWindowLog) stats(now time.Time) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cleanup(now)
+	return map[string]interface{}{
+		"request_count": s.Len(),
+		"capacity":      s.maxRequestCount,
+		"interval":      s.windowSize,
+	}
+}
+
+// idle reports if every logged request has left the window as of now
+func (s *slidingWindowLog) idle(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cleanup(now)
+	return s.Len() == 0
+}
+
+// timeToFit returns the earliest time at which there is room for n more
+// requests in the window. n must not exceed maxRequestCount.
+func (s *slidingWindowLog) timeToFit(n int) time.Time {
+	excess := s.Len() + n - s.maxRequestCount
+	if excess <= 0 {
+		return time.Time{}
+	}
+	// enough slots free up once the excess oldest requests leave the window.
+	// A sorted slice is still a valid heap.
+	sort.Sort(s.requestHeap)
+	return s.requests[excess-1].timestamp.Add(s.windowSize)
+}
+
+// reserve logs n requests at the earliest time there is room for them
+func (s *slidingWindowLog) reserve(clock Clock, n int) *Reservation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n > s.maxRequestCount {
+		return &Reservation{}
+	}
+	now := clock.Now()
+	s.cleanup(now)
+
+	at := s.timeToFit(n)
+	if at.Before(now) {
+		at = now
+	}
+	for i := 0; i < n; i++ {
+		heap.Push(s.requestHeap, requestLog{timestamp: at})
+	}
+	return &Reservation{
+		ok:        true,
+		timeToAct: at,
+		clock:     clock,
+		cancel:    func(time.Time) { s.release(n, at) },
+		decision:  s.decision(now),
+	}
+}
+
+// release removes n requests logged at the given time
+func (s *slidingWindowLog) release(n int, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.requests[:0]
+	for _, r := range s.requests {
+		if n > 0 && r.timestamp.Equal(at) {
+			n--
+			continue
+		}
+		kept = append(kept, r)
+	}
+	s.requests = kept
+	heap.Init(s.requestHeap)
 }
@@ -11,8 +11,9 @@ remove a token from the bucket.
 */
 
 import (
+	"context"
 	"fmt"
-	"strconv"
+	"math"
 	"sync"
 	"time"
 )
@@ -24,65 +25,137 @@ var (
 
 // TBLimiter is a token bucket limiter, satisfying the RateLimiter interface
 type TBLimiter struct {
-	// bucketMap is a map of userId to token bucket. Generally a bucket is
-	// created for each user/IP address
-	bucketMap map[string]*tokenBucket
-	// Mutex is a lock for bucketMap
-	*sync.RWMutex
-	// shutDown is a channel to stop the token pusher
-	shutDown chan struct{}
+	// buckets maps userId to token bucket. Generally a bucket is created
+	// for each user/IP address
+	buckets *keyStore[*tokenBucket]
 	// config is the configuration for the token bucket
 	config *TokenBucketConfig
+	// configLock guards config against SetRefillRate
+	configLock sync.RWMutex
+	clock      Clock
+}
+
+// newTBLimiter creates a TBLimiter with the buckets stored per the keyStoreConfig
+func newTBLimiter(config *TokenBucketConfig, keyStoreConfig KeyStoreConfig, clock Clock) *TBLimiter {
+	tbl := &TBLimiter{config: config, clock: clock}
+	tbl.buckets = newKeyStore(keyStoreConfig, clock, tbl.newBucket)
+	return tbl
 }
 
 // Allow checks if a request can be allowed.
 func (tbl *TBLimiter) Allow(Id string) error {
-	tbl.Lock()
-	defer tbl.Unlock()
+	return tbl.AllowN(Id, 1)
+}
 
-	bucket := tbl.bucketMap[Id]
-	if bucket == nil {
-		bucket = newTokenBucket(Id, tbl.config)
-		tbl.bucketMap[Id] = bucket
+// AllowN checks if a request costing n tokens can be allowed. Either all n
+// tokens are taken from the bucket or none are.
+func (tbl *TBLimiter) AllowN(Id string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
 	}
-	return bucket.allowRequest()
+	now := tbl.clock.Now()
+	return tbl.bucket(Id, now).allowRequest(now, n)
 }
 
-// Unregister remove a bucket from the @bucketMap
-func (tbl *TBLimiter) Unregister(Id string) {
-	tbl.Lock()
-	defer tbl.Unlock()
+// Decide checks if a request can be allowed and reports the state of the bucket
+func (tbl *TBLimiter) Decide(Id string) Decision {
+	now := tbl.clock.Now()
+	return tbl.bucket(Id, now).decide(now, 1)
+}
+
+// Reserve reserves a token for a request, see ReserveN
+func (tbl *TBLimiter) Reserve(Id string) *Reservation {
+	return tbl.ReserveN(Id, 1)
+}
+
+// ReserveN takes n tokens from the bucket even if it does not hold them yet.
+// The request may proceed once the missing tokens have been refilled.
+func (tbl *TBLimiter) ReserveN(Id string, n int) *Reservation {
+	if n < 0 {
+		return &Reservation{}
+	}
+	return tbl.bucket(Id, tbl.clock.Now()).reserve(tbl.clock, n)
+}
+
+// Wait blocks until a token is available for the request
+func (tbl *TBLimiter) Wait(ctx context.Context, Id string) error {
+	return tbl.WaitN(ctx, Id, 1)
+}
+
+// WaitN blocks until n tokens are available for the request
+func (tbl *TBLimiter) WaitN(ctx context.Context, Id string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	return wait(ctx, tbl.ReserveN(Id, n))
+}
+
+// bucket returns the bucket for the given Id, creating it if required
+func (tbl *TBLimiter) bucket(Id string, now time.Time) *tokenBucket {
+	return tbl.buckets.get(Id, now)
+}
+
+// newBucket creates a full bucket for the given Id
+func (tbl *TBLimiter) newBucket(Id string) *tokenBucket {
+	tbl.configLock.RLock()
+	defer tbl.configLock.RUnlock()
+	return newTokenBucket(Id, tbl.config, tbl.clock.Now())
+}
+
+// SetRefillRate changes the refill rate of all buckets, existing and new.
+// Tokens accumulated so far are refilled at the old rate.
+func (tbl *TBLimiter) SetRefillRate(rate float64) {
+	tbl.configLock.Lock()
+	config := *tbl.config
+	config.RefillRate = rate
+	tbl.config = &config
+	tbl.configLock.Unlock()
 
-	if bucket := tbl.bucketMap[Id]; bucket != nil {
+	now := tbl.clock.Now()
+	tbl.buckets.each(func(_ string, bucket *tokenBucket) {
+		bucket.setRefillRate(now, rate)
+	})
+}
+
+// RefillRate returns the current refill rate of the buckets
+func (tbl *TBLimiter) RefillRate() float64 {
+	tbl.configLock.RLock()
+	defer tbl.configLock.RUnlock()
+	return tbl.config.RefillRate
+}
+
+// Unregister remove a bucket from the @buckets
+func (tbl *TBLimiter) Unregister(Id string) {
+	if bucket, ok := tbl.buckets.remove(Id); ok {
 		bucket.Stop()
-		delete(tbl.bucketMap, Id)
 	}
 }
 
-// Stop stops the token pusher for all buckets
+// Stop stops the token pusher for all buckets and the idle bucket janitor
 func (tbl *TBLimiter) Stop() {
-	for _, bucket := range tbl.bucketMap {
+	tbl.buckets.close()
+	tbl.buckets.each(func(_ string, bucket *tokenBucket) {
 		bucket.Stop()
-	}
+	})
 }
 
-// Stats returns the stats for all buckets
+// Stats returns a snapshot of the stats for all buckets, as of the same time
 func (tbl *TBLimiter) Stats() interface{} {
-	data := make(map[string]interface{})
-	for key, bucket := range tbl.bucketMap {
-		data[key] = map[string]interface{}{
-			"tokens":             bucket.tokens,
-			"capacity":           bucket.capacity,
-			"refill_rate":        bucket.refillRate,
-			"tokens_to_be_added": bucket.nextRefillSize(),
-			"last_refill":        bucket.lastRefill,
-			"current_time":       time.Now(),
-		}
-	}
-	return data
+	return tbl.buckets.snapshot(tbl.clock.Now())
 }
 
-func (tbl *TBLimiter) GetLimit() int { return tbl.config.Capacity }
+func (tbl *TBLimiter) GetLimit() int {
+	tbl.configLock.RLock()
+	defer tbl.configLock.RUnlock()
+	return tbl.config.Capacity
+}
+
+// Window returns the time it takes an empty bucket to refill
+func (tbl *TBLimiter) Window() time.Duration {
+	tbl.configLock.RLock()
+	defer tbl.configLock.RUnlock()
+	return tbl.config.window()
+}
 
 // TokenBucketConfig is the configuration for the token bucket
 type TokenBucketConfig struct {
@@ -90,17 +163,24 @@ type TokenBucketConfig struct {
 	RefillRate float64 // tokens pushed into the bucket per second
 }
 
+// window returns the time it takes an empty bucket to refill, or 0 if it
+// never refills
+func (tbc *TokenBucketConfig) window() time.Duration {
+	if tbc.RefillRate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(tbc.Capacity) / tbc.RefillRate * float64(time.Second))
+}
+
 func (tbc *TokenBucketConfig) Parse(config map[string]string) error {
 	var err error
-	var value int64
 
-	value, err = strconv.ParseInt(config["capacity"], 10, 32)
+	tbc.Capacity, err = RateConfig(config).int("capacity")
 	if err != nil {
 		return err
 	}
-	tbc.Capacity = int(value)
 
-	tbc.RefillRate, err = strconv.ParseFloat(config["refill_rate"], 64)
+	tbc.RefillRate, err = RateConfig(config).float("refill_rate")
 	if err != nil {
 		return err
 	}
@@ -111,7 +191,7 @@ func (tbc *TokenBucketConfig) Parse(config map[string]string) error {
 type tokenBucket struct {
 	mu         *sync.Mutex
 	Id         string    // Id of the bucket - username/userid or IP address
-	tokens     int       // current number of tokens in the bucket
+	tokens     float64   // current number of tokens in the bucket
 	capacity   int       // max number of tokens in the bucket
 	refillRate float64   // tokenPushRate is the number of tokens pushed into the bucket per second
 	lastRefill time.Time // timestamp of last request
@@ -120,48 +200,161 @@ type tokenBucket struct {
 // Stop stops the token pusher
 func (tb *tokenBucket) Stop() {}
 
-// allowRequest checks if a request can be allowed
-func (tb *tokenBucket) allowRequest() error {
+// allowRequest checks if a request costing n tokens can be allowed
+func (tb *tokenBucket) allowRequest(now time.Time, n int) error {
+	if !tb.decide(now, n).Allowed {
+		return ErrBucketEmpty
+	}
+	return nil
+}
+
+// decide removes n tokens from the bucket if they are available and reports
+// the state of the bucket
+func (tb *tokenBucket) decide(now time.Time, n int) Decision {
+	return tb.decideAbove(now, n, 0)
+}
+
+// decideAbove removes n tokens from the bucket if at least floor tokens are
+// left afterwards, and reports the state of the bucket
+func (tb *tokenBucket) decideAbove(now time.Time, n int, floor float64) Decision {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
 
-	tb.refill()
+	tb.refill(now)
 
-	if tb.tokens <= 0 {
-		return ErrBucketEmpty
+	if tb.tokens-floor < float64(n) {
+		d := tb.decision(now)
+		d.RetryAfter = tb.timeUntil(float64(n) + floor)
+		return d
+	}
+	tb.tokens -= float64(n)
+	d := tb.decision(now)
+	d.Allowed = true
+	return d
+}
+
+// decision reports the state of the bucket, the lock must be held
+func (tb *tokenBucket) decision(now time.Time) Decision {
+	d := Decision{Limit: tb.capacity}
+	if tb.tokens > 0 {
+		d.Remaining = int(tb.tokens)
+	}
+	d.ResetAt = deadline(now, tb.timeUntil(float64(tb.capacity)))
+	return d
+}
+
+// stats returns the stats of the bucket as of now
+func (tb *tokenBucket) stats(now time.Time) map[string]interface{} {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	return map[string]interface{}{
+		"tokens":             tb.tokens,
+		"capacity":           tb.capacity,
+		"refill_rate":        tb.refillRate,
+		"tokens_to_be_added": tb.nextRefillSize(now),
+		"last_refill":        tb.lastRefill,
+		"current_time":       now,
+	}
+}
+
+// idle reports if the bucket has refilled completely as of now
+func (tb *tokenBucket) idle(now time.Time) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(now)
+	return tb.tokens >= float64(tb.capacity)
+}
+
+// reserve takes n tokens from the bucket, leaving it in debt if it holds
+// fewer than n tokens
+func (tb *tokenBucket) reserve(clock Clock, n int) *Reservation {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := clock.Now()
+	tb.refill(now)
+
+	delay := tb.timeUntil(float64(n))
+	if delay == maxWait {
+		return &Reservation{}
+	}
+	tb.tokens -= float64(n)
+	return &Reservation{
+		ok:        true,
+		timeToAct: now.Add(delay),
+		clock:     clock,
+		cancel:    func(now time.Time) { tb.release(now, n) },
+		decision:  tb.decision(now),
+	}
+}
+
+// release puts n reserved tokens back into the bucket
+func (tb *tokenBucket) release(now time.Time, n int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(now)
+	tb.tokens += float64(n)
+	if tb.tokens > float64(tb.capacity) {
+		tb.tokens = float64(tb.capacity)
 	}
-	tb.tokens--
-	return nil
 }
 
-// nextRefillSize returns the number of tokens to be added to the bucket as of time.now()
+// setRefillRate refills the bucket at the current rate and then changes it
+func (tb *tokenBucket) setRefillRate(now time.Time, rate float64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(now)
+	tb.refillRate = rate
+}
+
+// timeUntil returns the time it takes for the bucket to hold n tokens
+func (tb *tokenBucket) timeUntil(n float64) time.Duration {
+	missing := n - tb.tokens
+	if missing <= 0 {
+		return 0
+	}
+	if n > float64(tb.capacity) || tb.refillRate <= 0 {
+		return maxWait
+	}
+	return time.Duration(math.Ceil(missing / tb.refillRate * float64(time.Second)))
+}
+
+// nextRefillSize returns the number of tokens to be added to the bucket as of now
 // this is used for informational purpose only.
-func (tb *tokenBucket) nextRefillSize() int {
-	elapsed := time.Since(tb.lastRefill)
-	tokens := int(elapsed.Seconds()*tb.refillRate) + tb.tokens
+func (tb *tokenBucket) nextRefillSize(now time.Time) int {
+	elapsed := now.Sub(tb.lastRefill)
+	tokens := int(elapsed.Seconds()*tb.refillRate + tb.tokens)
 	if tokens > tb.capacity {
 		tokens = tb.capacity
 	}
 	return tokens
 }
 
-// refill adds tokens to the bucket
-func (tb *tokenBucket) refill() {
-	elapsed := time.Since(tb.lastRefill)
-	tb.tokens += int(elapsed.Seconds() * tb.refillRate)
-	if tb.tokens > tb.capacity {
-		tb.tokens = tb.capacity
+// refill adds the tokens accumulated since the last refill to the bucket.
+// Fractional tokens are kept, so slow refill rates are not lost to rounding.
+func (tb *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(tb.lastRefill)
+	if elapsed <= 0 {
+		return
+	}
+	tb.tokens += elapsed.Seconds() * tb.refillRate
+	if tb.tokens > float64(tb.capacity) {
+		tb.tokens = float64(tb.capacity)
 	}
-	tb.lastRefill = time.Now()
+	tb.lastRefill = now
 }
 
-func newTokenBucket(Id string, config *TokenBucketConfig) *tokenBucket {
+func newTokenBucket(Id string, config *TokenBucketConfig, now time.Time) *tokenBucket {
 	tb := tokenBucket{
 		Id:         Id,
-		tokens:     config.Capacity, // initially bucket is full
+		tokens:     float64(config.Capacity), // initially bucket is full
 		capacity:   config.Capacity,
 		refillRate: config.RefillRate,
-		lastRefill: time.Now(),
+		lastRefill: now,
 		mu:         &sync.Mutex{},
 	}
 	return &tb
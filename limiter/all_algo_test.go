@@ -5,9 +5,16 @@ Basic sanity tests for all the rate limiting algorithms
 */
 
 import (
+	"github.com/gin-gonic/gin"
+	"sync"
 	"testing"
+	"time"
 )
 
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
 func TestTokenBucket(t *testing.T) {
 	runTestCases(
 		t,
@@ -40,7 +47,7 @@ func TestTokenBucket(t *testing.T) {
 				numReq: 1,
 			},
 		},
-		IsValid,
+		defaultValidators,
 	)
 }
 
@@ -55,7 +62,7 @@ func TestNewSlidingWindowLogRateLimiter(t *testing.T) {
 			},
 			numReq: 100,
 		},
-	}, IsValid)
+	}, defaultValidators)
 }
 
 func TestFixedWindowCounter(t *testing.T) {
@@ -81,6 +88,418 @@ func TestFixedWindowCounter(t *testing.T) {
 				numReq: 15,
 			},
 		},
-		IsValid,
+		defaultValidators,
+	)
+}
+
+func TestGCRA(t *testing.T) {
+	runTestCases(
+		t,
+		[]TestCase{
+			{
+				name: "[GCRA] Equal burst and client requests",
+				config: RateConfig{
+					"algo":        "gcra",
+					"capacity":    "5",
+					"refill_rate": "10",
+				},
+				numReq: 5,
+			},
+			{
+				name: "[GCRA] Smaller burst than client requests",
+				config: RateConfig{
+					"algo":        "gcra",
+					"capacity":    "9",
+					"refill_rate": "10",
+				},
+				numReq: 10,
+			},
+			{
+				name: "[GCRA] Block requests",
+				config: RateConfig{
+					"algo":        "gcra",
+					"capacity":    "0",
+					"refill_rate": "10",
+				},
+				numReq: 1,
+			},
+		},
+		defaultValidators,
+	)
+}
+
+func TestLeakyBucket(t *testing.T) {
+	runTestCases(
+		t,
+		[]TestCase{
+			{
+				name: "[LeakyBucket] Equal bucket capacity and client requests",
+				config: RateConfig{
+					"algo":      "leaky_bucket",
+					"capacity":  "5",
+					"leak_rate": "1",
+				},
+				numReq: 5,
+			},
+			{
+				name: "[LeakyBucket] Smaller bucket capacity than client requests",
+				config: RateConfig{
+					"algo":       "leaky_bucket",
+					"capacity":   "5",
+					"leak_rate":  "1",
+					"leaky_mode": "meter",
+				},
+				numReq: 10,
+			},
+			{
+				name: "[LeakyBucket] Block requests",
+				config: RateConfig{
+					"algo":      "leaky_bucket",
+					"capacity":  "0",
+					"leak_rate": "1",
+				},
+				numReq: 3,
+			},
+		},
+		defaultValidators,
+	)
+}
+
+func TestConcurrency(t *testing.T) {
+	runTestCases(
+		t,
+		[]TestCase{
+			{
+				name:   "[Concurrency] Fewer slots than client requests",
+				config: RateConfig{"algo": "concurrency", "max_in_flight": "5"},
+				numReq: 10,
+			},
+			{
+				name:   "[Concurrency] Block requests",
+				config: RateConfig{"algo": "concurrency", "max_in_flight": "0"},
+				numReq: 3,
+			},
+		},
+		// requests made over HTTP release their slot once they are served
+		map[string]func(RateLimiter, int) error{
+			"direct":     IsValid,
+			"concurrent": IsValidConcurrent,
+		},
 	)
 }
+
+func TestConcurrencyDone(t *testing.T) {
+	limiter := NewRateLimiterFromConfig(RateConfig{
+		"algo": "concurrency", "max_in_flight": "2", "global_max_in_flight": "3",
+	}).(*ConcurrencyLimiter)
+	defer limiter.Stop()
+
+	allow := func(key string, want bool) {
+		t.Helper()
+		if err := limiter.Allow(key); (err == nil) != want {
+			t.Fatalf("%s: expected allowed=%v, got %v", key, want, err)
+		}
+	}
+	allow("a", true)
+	allow("a", true)
+	// the key is at its limit
+	allow("a", false)
+	allow("b", true)
+	// the global limit is reached
+	allow("b", false)
+	limiter.Done("a")
+	allow("b", true)
+	allow("a", false)
+
+	limiter.DoneN("a", 1)
+	limiter.DoneN("b", 2)
+	// releasing more than was taken does not free extra slots
+	limiter.Done("b")
+	if n := limiter.global.Load(); n != 0 {
+		t.Fatalf("expected no requests in flight, got %d", n)
+	}
+	if d := limiter.Decide("a"); !d.Allowed || d.Remaining != 1 {
+		t.Fatalf("expected one slot left, got %+v", d)
+	}
+
+	// extra Done calls of a key with nothing in flight, or of an unknown
+	// key, do not free the global slots of other keys
+	allow("b", true)
+	allow("c", true)
+	limiter.Done("b")
+	limiter.Done("b")
+	limiter.Done("unknown")
+	if n := limiter.global.Load(); n != 2 {
+		t.Fatalf("expected 2 requests in flight, got %d", n)
+	}
+	if _, ok := limiter.slots.lookup("unknown"); ok {
+		t.Fatal("expected Done not to create the key")
+	}
+	// unregistering a key releases its global slots
+	limiter.Unregister("c")
+	if n := limiter.global.Load(); n != 1 {
+		t.Fatalf("expected 1 request in flight, got %d", n)
+	}
+}
+
+func TestConcurrencyMaxKeys(t *testing.T) {
+	limiter := NewRateLimiterFromConfig(RateConfig{
+		"algo": "concurrency", "max_in_flight": "1", "global_max_in_flight": "1", "max_keys": "1", "shards": "1",
+	}).(*ConcurrencyLimiter)
+	defer limiter.Stop()
+
+	if err := limiter.Allow("a"); err != nil {
+		t.Fatal(err)
+	}
+	// a key with requests in flight is not evicted to make room for another
+	if err := limiter.Allow("b"); err == nil {
+		t.Fatal("expected b to be rejected while a is in flight")
+	}
+	if n := limiter.global.Load(); n != 1 {
+		t.Fatalf("expected 1 request in flight, got %d", n)
+	}
+	// a key is forgotten as soon as it has nothing in flight
+	limiter.Done("a")
+	if n := limiter.slots.len(); n != 0 {
+		t.Fatalf("expected the key to be removed, got %d keys", n)
+	}
+	if err := limiter.Allow("b"); err != nil {
+		t.Fatalf("expected b to be allowed once a is done, got %v", err)
+	}
+}
+
+func TestAdaptive(t *testing.T) {
+	runTestCases(
+		t,
+		[]TestCase{
+			{
+				name: "[Adaptive] Smaller capacity than client requests",
+				config: RateConfig{
+					"algo":        "adaptive",
+					"capacity":    "5",
+					"refill_rate": "10",
+				},
+				numReq: 10,
+			},
+		},
+		defaultValidators,
+	)
+}
+
+func TestQuota(t *testing.T) {
+	runTestCases(
+		t,
+		[]TestCase{
+			{
+				name:   "[Quota] Smaller quota than client requests",
+				config: RateConfig{"algo": "quota", "quota": "5", "quota_period": "day"},
+				numReq: 10,
+			},
+			{
+				name:   "[Quota] Block requests",
+				config: RateConfig{"algo": "quota", "quota": "0", "quota_period": "month", "timezone": "Asia/Kolkata"},
+				numReq: 3,
+			},
+		},
+		defaultValidators,
+	)
+}
+
+func TestSlidingWindowCounter(t *testing.T) {
+	runTestCases(
+		t,
+		[]TestCase{
+			{
+				name: "[SlidingWindowCounter] Block requests",
+				config: RateConfig{
+					"algo":              "sliding_window_counter",
+					"max_request_count": "0",
+					"window_size":       "10s",
+				},
+				numReq: 5,
+			},
+			{
+				name: "[SlidingWindowCounter] Large window size, num requests more than window size",
+				config: RateConfig{
+					"algo":              "sliding_window_counter",
+					"max_request_count": "5",
+					"window_size":       "10s",
+				},
+				numReq: 15,
+			},
+		},
+		defaultValidators,
+	)
+}
+
+func TestDecide(t *testing.T) {
+	testCases := []struct {
+		name          string
+		config        RateConfig
+		maxRetryAfter time.Duration
+	}{
+		{
+			name:          "[TokenBucket] Retry after one token is refilled",
+			config:        RateConfig{"algo": "token_bucket", "capacity": "3", "refill_rate": "1"},
+			maxRetryAfter: time.Second,
+		},
+		{
+			name:          "[FixedWindowCount] Retry after the window resets",
+			config:        RateConfig{"algo": "fixed_window_counter", "max_request_count": "3", "window_size": "10s"},
+			maxRetryAfter: 10 * time.Second,
+		},
+		{
+			name:          "[SlidingWindowLog] Retry after the oldest request leaves the window",
+			config:        RateConfig{"algo": "sliding_window_log", "request_per_sec": "1", "window_size": "3s"},
+			maxRetryAfter: 3 * time.Second,
+		},
+		{
+			name:          "[SlidingWindowCounter] Retry after the weighted estimate drops",
+			config:        RateConfig{"algo": "sliding_window_counter", "max_request_count": "3", "window_size": "10s"},
+			maxRetryAfter: 20 * time.Second,
+		},
+		{
+			name:          "[GCRA] Retry after one emission interval",
+			config:        RateConfig{"algo": "gcra", "capacity": "3", "refill_rate": "1"},
+			maxRetryAfter: time.Second,
+		},
+		{
+			name:          "[LeakyBucket] Retry after one request leaks",
+			config:        RateConfig{"algo": "leaky_bucket", "capacity": "3", "leak_rate": "1"},
+			maxRetryAfter: time.Second,
+		},
+		{
+			name:          "[Composite] Retry after the most restrictive limit allows it",
+			config:        RateConfig{"algo": "composite", "limits": "token_bucket:capacity=3,refill_rate=1;fixed_window_counter:max_request_count=10,window_size=10s"},
+			maxRetryAfter: time.Second,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			limiter := NewRateLimiterFromConfig(tc.config)
+			for i := 0; i < 3; i++ {
+				d := limiter.Decide("user")
+				if !d.Allowed || d.Limit != 3 || d.Remaining != 2-i || d.RetryAfter != 0 {
+					t.Fatalf("request %d: unexpected decision %+v", i, d)
+				}
+			}
+			d := limiter.Decide("user")
+			if d.Allowed || d.Remaining != 0 {
+				t.Fatalf("expected rejection, got %+v", d)
+			}
+			if d.RetryAfter <= 0 || d.RetryAfter > tc.maxRetryAfter {
+				t.Fatalf("expected retry after in (0, %s], got %s", tc.maxRetryAfter, d.RetryAfter)
+			}
+			if !d.ResetAt.After(time.Now()) {
+				t.Fatalf("expected reset time in the future, got %s", d.ResetAt)
+			}
+		})
+	}
+}
+
+func TestGCRAStats(t *testing.T) {
+	limiter, _ := newFakeClockLimiter(RateConfig{"algo": "gcra", "capacity": "3", "refill_rate": "1"})
+	defer limiter.Stop()
+
+	for i := 0; i < 4; i++ {
+		_ = limiter.Allow("user")
+	}
+	stats := limiter.Stats().(map[string]interface{})["user"].(map[string]interface{})
+	if stats["limit"] != 1.0 || stats["burst"] != 3 || stats["remaining"] != 0 || stats["retry_after"] != time.Second {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+}
+
+func TestAllowN(t *testing.T) {
+	configs := []RateConfig{
+		{"algo": "token_bucket", "capacity": "5", "refill_rate": "0.001"},
+		{"algo": "fixed_window_counter", "max_request_count": "5", "window_size": "10s"},
+		{"algo": "sliding_window_log", "request_per_sec": "1", "window_size": "5s"},
+		{"algo": "sliding_window_counter", "max_request_count": "5", "window_size": "10s"},
+		{"algo": "gcra", "capacity": "5", "refill_rate": "0.001"},
+		{"algo": "leaky_bucket", "capacity": "5", "leak_rate": "0.001"},
+		{"algo": "concurrency", "max_in_flight": "5"},
+		{"algo": "quota", "quota": "5", "quota_period": "month"},
+		{"algo": "hierarchical", "user_capacity": "5", "user_refill_rate": "0.001", "org_capacity": "10", "org_refill_rate": "0.001"},
+		{"algo": "composite", "limits": "token_bucket:capacity=5,refill_rate=0.001;fixed_window_counter:max_request_count=10,window_size=10s"},
+	}
+	for _, config := range configs {
+		t.Run(config["algo"], func(t *testing.T) {
+			limiter := NewRateLimiterFromConfig(config)
+			if err := limiter.AllowN("user", 3); err != nil {
+				t.Fatalf("expected 3 of 5 to be allowed, got %v", err)
+			}
+			// only 2 left, a cost of 3 must be rejected without consuming anything
+			if err := limiter.AllowN("user", 3); err == nil {
+				t.Fatal("expected 3 of the remaining 2 to be rejected")
+			}
+			if err := limiter.AllowN("user", 2); err != nil {
+				t.Fatalf("expected the remaining 2 to be allowed, got %v", err)
+			}
+			if err := limiter.Allow("user"); err == nil {
+				t.Fatal("expected request to be rejected once the limit is used up")
+			}
+			if err := limiter.AllowN("user", -1); err != ErrInvalidCost {
+				t.Fatalf("expected ErrInvalidCost, got %v", err)
+			}
+			if d := limiter.Decide("other"); !d.Allowed {
+				t.Fatalf("expected other keys to be unaffected, got %+v", d)
+			}
+		})
+	}
+}
+
+// TestConcurrentAccess hammers Allow, Unregister and Stats of every limiter
+// from many goroutines, run with -race to catch unsynchronised access
+func TestConcurrentAccess(t *testing.T) {
+	configs := []RateConfig{
+		{"algo": "token_bucket", "capacity": "10", "refill_rate": "100"},
+		{"algo": "fixed_window_counter", "max_request_count": "10", "window_size": "10ms"},
+		{"algo": "sliding_window_log", "request_per_sec": "10", "window_size": "1s"},
+		{"algo": "sliding_window_counter", "max_request_count": "10", "window_size": "10ms"},
+		{"algo": "gcra", "capacity": "10", "refill_rate": "100"},
+		{"algo": "leaky_bucket", "capacity": "10", "leak_rate": "100"},
+		{"algo": "concurrency", "max_in_flight": "10", "global_max_in_flight": "20"},
+		{"algo": "quota", "quota": "10", "quota_period": "minute"},
+	}
+	keys := []string{"a", "b", "c", "d"}
+	for _, config := range configs {
+		config := config
+		t.Run(config["algo"], func(t *testing.T) {
+			t.Parallel()
+			config["max_keys"] = "2"
+			config["max_quotas"] = "2"
+			config["shards"] = "2"
+			limiter := NewRateLimiterFromConfig(config)
+			defer limiter.Stop()
+
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < 200; i++ {
+						key := keys[(g+i)%len(keys)]
+						switch i % 10 {
+						case 0:
+							limiter.Unregister(key)
+						case 1:
+							stats := limiter.Stats().(map[string]interface{})
+							if quotas, ok := stats["quotas"]; ok {
+								stats = quotas.(map[string]interface{})
+							}
+							if len(stats) > 2 {
+								t.Errorf("expected at most 2 keys, got %d", len(stats))
+							}
+						case 2:
+							_ = limiter.Decide(key)
+						default:
+							_ = limiter.AllowN(key, 1+i%2)
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package limiter
+
+/*
+Throughput benchmarks. Run with different GOMAXPROCS values to see the
+limiters scale with the number of CPUs, e.g.
+
+	go test -run '^$' -bench . -cpu 1,2,4,8 ./limiter
+*/
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+var benchmarkConfigs = []RateConfig{
+	{"algo": "token_bucket", "capacity": "1000000000", "refill_rate": "1000000000"},
+	{"algo": "fixed_window_counter", "max_request_count": "1000000000", "window_size": "1h"},
+	{"algo": "sliding_window_counter", "max_request_count": "1000000000", "window_size": "1h"},
+	{"algo": "gcra", "capacity": "1000000000", "refill_rate": "1000000000"},
+}
+
+// benchmarkKeys is the number of distinct keys requests are spread over
+const benchmarkKeys = 1024
+
+func benchmarkKeyNames() []string {
+	keys := make([]string, benchmarkKeys)
+	for i := range keys {
+		keys[i] = "user-" + strconv.Itoa(i)
+	}
+	return keys
+}
+
+// BenchmarkAllow measures Allow with requests spread over many keys, with the
+// keys in a single shard (i.e. one lock) and in the default number of shards
+func BenchmarkAllow(b *testing.B) {
+	keys := benchmarkKeyNames()
+	for _, config := range benchmarkConfigs {
+		for _, shards := range []string{"1", strconv.Itoa(DefaultShards)} {
+			config, shards := config, shards
+			b.Run(config["algo"]+"/shards="+shards, func(b *testing.B) {
+				cfg := RateConfig{"shards": shards}
+				for k, v := range config {
+					cfg[k] = v
+				}
+				limiter := NewRateLimiterFromConfig(cfg)
+				defer limiter.Stop()
+
+				var next uint32
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					i := atomic.AddUint32(&next, 1) * 7919
+					for pb.Next() {
+						_ = limiter.Allow(keys[i%benchmarkKeys])
+						i++
+					}
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkAllowSingleKey measures Allow when every request has the same key
+func BenchmarkAllowSingleKey(b *testing.B) {
+	for _, config := range benchmarkConfigs {
+		config := config
+		b.Run(config["algo"], func(b *testing.B) {
+			limiter := NewRateLimiterFromConfig(config)
+			defer limiter.Stop()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_ = limiter.Allow("user")
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkServer measures the /limited route, served in process
+func BenchmarkServer(b *testing.B) {
+	keys := benchmarkKeyNames()
+	limiter := NewRateLimiterFromConfig(benchmarkConfigs[0])
+	defer limiter.Stop()
+	handler := NewServer(limiter).Handler()
+
+	var next uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := atomic.AddUint32(&next, 1) * 7919
+		for pb.Next() {
+			req := httptest.NewRequest(http.MethodGet, "/limited", nil)
+			req.Header.Set("X-User", keys[i%benchmarkKeys])
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			i++
+		}
+	})
+}
@@ -0,0 +1,369 @@
+package limiter
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// step is an action in a deterministic limiter test: advance the clock, then
+// make requests and check how many were allowed
+type step struct {
+	advance time.Duration
+	numReq  int
+	allowed int
+}
+
+func runSteps(t *testing.T, config RateConfig, steps []step) {
+	limiter, clock := newFakeClockLimiter(config)
+	defer limiter.Stop()
+
+	for i, s := range steps {
+		clock.Advance(s.advance)
+		allowed := 0
+		for j := 0; j < s.numReq; j++ {
+			if limiter.Allow("user") == nil {
+				allowed++
+			}
+		}
+		if allowed != s.allowed {
+			t.Fatalf("step %d: expected %d of %d requests to be allowed, got %d", i, s.allowed, s.numReq, allowed)
+		}
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	runSteps(t, RateConfig{"algo": "token_bucket", "capacity": "5", "refill_rate": "2"}, []step{
+		{numReq: 10, allowed: 5},
+		// 0.5 tokens are kept, not rounded away
+		{advance: 250 * time.Millisecond, numReq: 1, allowed: 0},
+		{advance: 250 * time.Millisecond, numReq: 2, allowed: 1},
+		{advance: 1500 * time.Millisecond, numReq: 5, allowed: 3},
+		// the bucket never holds more than its capacity
+		{advance: time.Hour, numReq: 10, allowed: 5},
+	})
+}
+
+func TestGCRARefill(t *testing.T) {
+	// GCRA has the same semantics as the token bucket
+	runSteps(t, RateConfig{"algo": "gcra", "capacity": "5", "refill_rate": "2"}, []step{
+		{numReq: 10, allowed: 5},
+		{advance: 250 * time.Millisecond, numReq: 1, allowed: 0},
+		{advance: 250 * time.Millisecond, numReq: 2, allowed: 1},
+		{advance: 1500 * time.Millisecond, numReq: 5, allowed: 3},
+		{advance: time.Hour, numReq: 10, allowed: 5},
+	})
+}
+
+func TestFixedWindowRollover(t *testing.T) {
+	runSteps(t, RateConfig{"algo": "fixed_window_counter", "max_request_count": "3", "window_size": "1s"}, []step{
+		{numReq: 5, allowed: 3},
+		{advance: time.Second, numReq: 1, allowed: 0},
+		{advance: time.Millisecond, numReq: 5, allowed: 3},
+		{advance: 500 * time.Millisecond, numReq: 1, allowed: 0},
+	})
+}
+
+func TestSlidingWindowLogExpiry(t *testing.T) {
+	runSteps(t, RateConfig{"algo": "sliding_window_log", "request_per_sec": "1", "window_size": "3s"}, []step{
+		{numReq: 2, allowed: 2},
+		{advance: time.Second, numReq: 2, allowed: 1},
+		// the first 2 requests leave the window, the third one is still in it
+		{advance: 2 * time.Second, numReq: 3, allowed: 2},
+		{advance: time.Second, numReq: 2, allowed: 1},
+	})
+}
+
+func TestSlidingWindowCounterWeighting(t *testing.T) {
+	runSteps(t, RateConfig{"algo": "sliding_window_counter", "max_request_count": "4", "window_size": "1s"}, []step{
+		{numReq: 6, allowed: 4},
+		// a quarter into the next window, 3 of the previous 4 still count
+		{advance: 1250 * time.Millisecond, numReq: 2, allowed: 1},
+		// half way, 2 of the previous 4 and the 1 of the current window count
+		{advance: 250 * time.Millisecond, numReq: 2, allowed: 1},
+		// two windows later nothing counts
+		{advance: 2 * time.Second, numReq: 6, allowed: 4},
+	})
+}
+
+func TestLeakyBucketMeterLeak(t *testing.T) {
+	runSteps(t, RateConfig{"algo": "leaky_bucket", "capacity": "4", "leak_rate": "2"}, []step{
+		{numReq: 6, allowed: 4},
+		// half a request leaked, not enough room for a whole one
+		{advance: 250 * time.Millisecond, numReq: 1, allowed: 0},
+		{advance: 250 * time.Millisecond, numReq: 2, allowed: 1},
+		// the bucket never leaks below empty
+		{advance: time.Hour, numReq: 6, allowed: 4},
+	})
+}
+
+func TestLeakyBucketQueue(t *testing.T) {
+	limiter, clock := newFakeClockLimiter(RateConfig{
+		"algo": "leaky_bucket", "capacity": "3", "leak_rate": "10", "leaky_mode": "queue", "queue_timeout": "250ms",
+	})
+	defer limiter.Stop()
+
+	now := clock.Now()
+	bucket := limiter.(*LeakyBucketLimiter).buckets.get("user", now)
+	// requests are released one emission interval apart
+	for i, want := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		if d, delay, err := bucket.decide(now, 1); err != nil || delay != want || d.Remaining != 2-i {
+			t.Fatalf("request %d: expected a delay of %s, got %s, %+v, %v", i, want, delay, d, err)
+		}
+	}
+	if d, _, err := bucket.decide(now, 1); err != ErrQueueFull || d.RetryAfter != 100*time.Millisecond {
+		t.Fatalf("expected the queue to be full for 100ms, got %+v, %v", d, err)
+	}
+
+	// one request left the queue, the next one waits behind the other two
+	now = now.Add(100 * time.Millisecond)
+	if _, delay, err := bucket.decide(now, 1); err != nil || delay != 200*time.Millisecond {
+		t.Fatalf("expected a delay of 200ms, got %s, %v", delay, err)
+	}
+
+}
+
+func TestLeakyBucketQueueTimeout(t *testing.T) {
+	limiter, clock := newFakeClockLimiter(RateConfig{
+		"algo": "leaky_bucket", "capacity": "10", "leak_rate": "10", "leaky_mode": "queue", "queue_timeout": "150ms",
+	})
+	defer limiter.Stop()
+
+	now := clock.Now()
+	bucket := limiter.(*LeakyBucketLimiter).buckets.get("user", now)
+	_, _, _ = bucket.decide(now, 1)
+	_, _, _ = bucket.decide(now, 1)
+	// the queue has room, but the request would wait 200ms
+	if d, _, err := bucket.decide(now, 1); err != ErrQueueTimeout || d.RetryAfter != 50*time.Millisecond {
+		t.Fatalf("expected the request to time out, got %+v, %v", d, err)
+	}
+}
+
+func TestLeakyBucketQueueBlocks(t *testing.T) {
+	limiter, clock := newFakeClockLimiter(RateConfig{
+		"algo": "leaky_bucket", "capacity": "2", "leak_rate": "1", "leaky_mode": "queue",
+	})
+	defer limiter.Stop()
+
+	if err := limiter.Allow("user"); err != nil {
+		t.Fatalf("expected the first request to be released right away, got %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- limiter.Allow("user") }()
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("expected the second request to wait in the queue, got %v", err)
+	default:
+	}
+	clock.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatalf("expected the second request to be released after a second, got %v", err)
+	}
+}
+
+func TestQuotaCalendarReset(t *testing.T) {
+	// the fake clock starts on Monday 2024-01-01 00:00 UTC
+	runSteps(t, RateConfig{"algo": "quota", "quota": "3", "quota_period": "month"}, []step{
+		{numReq: 5, allowed: 3},
+		{advance: 30*24*time.Hour + 23*time.Hour, numReq: 1, allowed: 0},
+		{advance: time.Hour, numReq: 5, allowed: 3},
+	})
+	runSteps(t, RateConfig{"algo": "quota", "quota": "3", "quota_period": "week"}, []step{
+		{numReq: 5, allowed: 3},
+		{advance: 6*24*time.Hour + 23*time.Hour, numReq: 1, allowed: 0},
+		{advance: time.Hour, numReq: 5, allowed: 3},
+	})
+	// 00:00 UTC is 05:30 in Kolkata, the day ends at 18:30 UTC
+	runSteps(t, RateConfig{"algo": "quota", "quota": "3", "quota_period": "day", "timezone": "Asia/Kolkata"}, []step{
+		{numReq: 5, allowed: 3},
+		{advance: 18*time.Hour + 29*time.Minute, numReq: 1, allowed: 0},
+		{advance: time.Minute, numReq: 5, allowed: 3},
+	})
+}
+
+func TestQuotaTopUpAndReset(t *testing.T) {
+	limiter, clock := newFakeClockLimiter(RateConfig{"algo": "quota", "quota": "2", "quota_period": "hour"})
+	defer limiter.Stop()
+	q := limiter.(*QuotaLimiter)
+
+	_ = q.AllowN("user", 2)
+	if d := q.Decide("user"); d.Allowed || d.RetryAfter != time.Hour || !d.ResetAt.Equal(clock.Now().Add(time.Hour)) {
+		t.Fatalf("expected the quota to reset in an hour, got %+v", d)
+	}
+	if err := q.TopUp("user", 3); err != nil {
+		t.Fatal(err)
+	}
+	if n := q.Remaining("user"); n != 3 {
+		t.Fatalf("expected 3 requests left after the top up, got %d", n)
+	}
+	_ = q.AllowN("user", 3)
+	q.Reset("user")
+	if n := q.Remaining("user"); n != 2 {
+		t.Fatalf("expected the full quota after a reset, got %d", n)
+	}
+
+	// top ups do not carry over to the next period
+	_ = q.TopUp("user", 3)
+	clock.Advance(time.Hour)
+	if n := q.Remaining("user"); n != 2 {
+		t.Fatalf("expected the top up to expire with the period, got %d", n)
+	}
+}
+
+func TestQuotaReserveNextPeriod(t *testing.T) {
+	limiter, clock := newFakeClockLimiter(RateConfig{"algo": "quota", "quota": "2", "quota_period": "minute"})
+	defer limiter.Stop()
+	q := limiter.(*QuotaLimiter)
+
+	clock.Advance(30 * time.Second)
+	_ = q.AllowN("user", 2)
+	if r := q.ReserveN("user", 2); !r.OK() || r.Delay() != 30*time.Second {
+		t.Fatalf("expected the requests to be reserved for the next minute, got %s", r.Delay())
+	}
+	if r := q.ReserveN("user", 3); r.OK() {
+		t.Fatal("expected more than the quota to never be allowed")
+	}
+	clock.Advance(30 * time.Second)
+	if n := q.Remaining("user"); n != 0 {
+		t.Fatalf("expected the reserved requests to use the new period's quota, got %d left", n)
+	}
+}
+
+func TestQuotaNeverEvicted(t *testing.T) {
+	limiter, clock := newFakeClockLimiter(RateConfig{
+		"algo": "quota", "quota": "1", "quota_period": "day", "max_quotas": "2", "max_keys": "1", "idle_ttl": "1m",
+	})
+	defer limiter.Stop()
+	q := limiter.(*QuotaLimiter)
+
+	_ = q.Allow("alice")
+	_ = q.Allow("bob")
+	// new ids are rejected rather than evicting a used quota
+	if err := q.Allow("carol"); err != ErrTooManyQuotas {
+		t.Fatalf("expected %v once max_quotas quotas are tracked, got %v", ErrTooManyQuotas, err)
+	}
+	// the limiter fails closed, which its stats tell
+	if stats := q.Stats().(map[string]interface{}); stats["tracked"] != 2 || stats["max_quotas"] != 2 || stats["rejected_ids"] != int64(1) {
+		t.Fatalf("expected the stats to show the rejected id, got %v", stats)
+	}
+	if d := q.Decide("carol"); d.Allowed || d.RetryAfter != 24*time.Hour {
+		t.Fatalf("expected carol to retry in the next period, got %+v", d)
+	}
+	if err := q.Allow("alice"); err != ErrQuotaExceeded {
+		t.Fatalf("expected alice's quota to be kept, got %v", err)
+	}
+
+	// idle for longer than idle_ttl, yet still in the period
+	clock.Advance(time.Hour)
+	q.quotas.evictIdle(clock.Now())
+	if err := q.Allow("bob"); err != ErrQuotaExceeded {
+		t.Fatalf("expected bob's quota to be kept until the period ends, got %v", err)
+	}
+	clock.Advance(24 * time.Hour)
+	q.quotas.evictIdle(clock.Now())
+	if err := q.Allow("carol"); err != nil {
+		t.Fatalf("expected the idle quotas to make room in the next period, got %v", err)
+	}
+}
+
+func TestPriorityShedding(t *testing.T) {
+	limiter, clock := newFakeClockLimiter(RateConfig{
+		"algo": "priority", "capacity": "10", "refill_rate": "1", "critical_reserve": "0.2", "default_reserve": "0.3",
+	})
+	defer limiter.Stop()
+	p := limiter.(*PriorityLimiter)
+
+	allowed := func(priority Priority, numReq int) int {
+		n := 0
+		for i := 0; i < numReq; i++ {
+			if p.AllowPriority("user", priority) == nil {
+				n++
+			}
+		}
+		return n
+	}
+	steps := []struct {
+		advance  time.Duration
+		priority Priority
+		numReq   int
+		allowed  int
+	}{
+		// sheddable requests must leave half of the bucket
+		{priority: PrioritySheddable, numReq: 10, allowed: 5},
+		// default requests must leave the critical reserve
+		{priority: PriorityDefault, numReq: 10, allowed: 3},
+		{priority: PriorityCritical, numReq: 10, allowed: 2},
+		{advance: time.Second, priority: PrioritySheddable, numReq: 1, allowed: 0},
+		{priority: PriorityCritical, numReq: 1, allowed: 1},
+		{advance: 5 * time.Second, priority: PriorityDefault, numReq: 1, allowed: 1},
+	}
+	for i, s := range steps {
+		clock.Advance(s.advance)
+		if n := allowed(s.priority, s.numReq); n != s.allowed {
+			t.Fatalf("step %d: expected %d of %d %s requests to be allowed, got %d", i, s.allowed, s.numReq, s.priority, n)
+		}
+	}
+
+	classes := p.Stats().(map[string]interface{})["classes"].(map[string]interface{})
+	sheddable := classes["sheddable"].(map[string]interface{})
+	if sheddable["admitted"] != int64(5) || sheddable["rejected"] != int64(6) {
+		t.Fatalf("expected 5 admitted and 6 rejected sheddable requests, got %v", sheddable)
+	}
+}
+
+func TestAdaptiveAIMD(t *testing.T) {
+	limiter, clock := newFakeClockLimiter(RateConfig{
+		"algo": "adaptive", "capacity": "1", "refill_rate": "10", "min_rate": "2", "max_rate": "12",
+		"target_latency": "100ms",
+	})
+	defer limiter.Stop()
+	adaptive := limiter.(*AdaptiveLimiter)
+	_ = adaptive.Allow("user")
+
+	steps := []struct {
+		advance time.Duration
+		latency time.Duration
+		err     error
+		rate    float64
+	}{
+		// the rate is adjusted at most once per interval
+		{latency: 10 * time.Millisecond, rate: 10},
+		{advance: time.Second, latency: 10 * time.Millisecond, rate: 11},
+		{advance: time.Second, latency: 10 * time.Millisecond, rate: 12},
+		{advance: time.Second, latency: 10 * time.Millisecond, rate: 12},
+		{advance: time.Second, err: fmt.Errorf("unavailable"), rate: 6},
+		// a single slow request pushes the smoothed latency above the target
+		{advance: time.Second, latency: 500 * time.Millisecond, rate: 3},
+		{advance: time.Second, latency: 500 * time.Millisecond, rate: 2},
+	}
+	for i, s := range steps {
+		clock.Advance(s.advance)
+		adaptive.Feedback(s.latency, s.err)
+		if rate := adaptive.Limit(); rate != s.rate {
+			t.Fatalf("step %d: expected a rate of %v, got %v", i, s.rate, rate)
+		}
+	}
+
+	// existing buckets refill at the adapted rate
+	stats := adaptive.TBLimiter.Stats().(map[string]interface{})
+	if rate := stats["user"].(map[string]interface{})["refill_rate"]; rate != 2.0 {
+		t.Fatalf("expected the bucket to refill at 2 tokens per second, got %v", rate)
+	}
+}
+
+func TestDecideWithFakeClock(t *testing.T) {
+	limiter, clock := newFakeClockLimiter(RateConfig{"algo": "token_bucket", "capacity": "2", "refill_rate": "4"})
+	defer limiter.Stop()
+
+	_ = limiter.AllowN("user", 2)
+	d := limiter.Decide("user")
+	if d.Allowed || d.RetryAfter != 250*time.Millisecond {
+		t.Fatalf("expected a retry after 250ms, got %+v", d)
+	}
+	if want := clock.Now().Add(500 * time.Millisecond); !d.ResetAt.Equal(want) {
+		t.Fatalf("expected the bucket to be full at %s, got %s", want, d.ResetAt)
+	}
+}
@@ -0,0 +1,249 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLimitRejected = fmt.Errorf("rejected by one of the limits")
+)
+
+// CompositeLimiter enforces several limits at once (e.g. 10/s and 1000/day),
+// satisfying the BlockingRateLimiter interface. A request takes capacity from
+// every limit or from none of them: capacity is reserved from all the limits
+// and handed back if any of them can not admit the request right away.
+type CompositeLimiter struct {
+	limits []BlockingRateLimiter
+	clock  Clock
+	// locks serialize the requests of the keys hashed to them, so that no
+	// request sees the capacity another one reserved only to hand it back
+	locks [DefaultShards]sync.Mutex
+}
+
+// NewCompositeLimiter creates a CompositeLimiter of the limits, in order. The
+// limits should tell the time with the same clock as the composite limiter.
+func NewCompositeLimiter(limits []BlockingRateLimiter, opts ...Option) (*CompositeLimiter, error) {
+	if len(limits) == 0 {
+		return nil, fmt.Errorf("a composite limiter needs at least one limit")
+	}
+	o := &options{clock: RealClock()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return &CompositeLimiter{limits: limits, clock: o.clock}, nil
+}
+
+// Allow checks if a request can be allowed by every limit
+func (c *CompositeLimiter) Allow(id string) error {
+	return c.AllowN(id, 1)
+}
+
+// AllowN checks if a request counting as n requests can be allowed by every
+// limit. The error names the first limit that rejected it.
+func (c *CompositeLimiter) AllowN(id string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	if _, rejectedBy := c.Evaluate(id, n); rejectedBy >= 0 {
+		return fmt.Errorf("%w: limit %d", ErrLimitRejected, rejectedBy)
+	}
+	return nil
+}
+
+// Decide checks if a request can be allowed by every limit and reports the
+// state of the most restrictive one
+func (c *CompositeLimiter) Decide(id string) Decision {
+	d, _ := c.Evaluate(id, 1)
+	return d
+}
+
+// Evaluate checks if a request counting as n requests can be allowed by every
+// limit. It returns the index of the first limit that rejected it, or -1 if it
+// was allowed. The RetryAfter of a rejected request is the longest of the limits.
+func (c *CompositeLimiter) Evaluate(id string, n int) (Decision, int) {
+	lock := c.lock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	r, rejectedBy := c.reserve(id, n)
+	d := r.decision
+	if rejectedBy < 0 {
+		d.Allowed = true
+		return d, -1
+	}
+	d.RetryAfter = r.Delay()
+	r.Cancel()
+	return d, rejectedBy
+}
+
+// Reserve reserves capacity for a request from every limit, see ReserveN
+func (c *CompositeLimiter) Reserve(id string) *Reservation {
+	return c.ReserveN(id, 1)
+}
+
+// ReserveN reserves capacity for a request counting as n requests from every
+// limit. The request may proceed once the longest delay has passed.
+func (c *CompositeLimiter) ReserveN(id string, n int) *Reservation {
+	lock := c.lock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	r, _ := c.reserve(id, n)
+	return r
+}
+
+// Wait blocks until every limit allows the request
+func (c *CompositeLimiter) Wait(ctx context.Context, id string) error {
+	return c.WaitN(ctx, id, 1)
+}
+
+// WaitN blocks until every limit allows a request counting as n requests
+func (c *CompositeLimiter) WaitN(ctx context.Context, id string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	return wait(ctx, c.ReserveN(id, n))
+}
+
+// lock returns the lock of the key's requests
+func (c *CompositeLimiter) lock(id string) *sync.Mutex {
+	return &c.locks[keyHash(id)%uint32(len(c.locks))]
+}
+
+// reserve reserves n from every limit and returns the combined reservation,
+// along with the index of the first limit that delays it (-1 if none does).
+// If a limit can never allow the request, nothing stays reserved.
+func (c *CompositeLimiter) reserve(id string, n int) (*Reservation, int) {
+	reservations := make([]*Reservation, len(c.limits))
+	for i, limit := range c.limits {
+		reservations[i] = limit.ReserveN(id, n)
+	}
+	cancel := func() {
+		for _, r := range reservations {
+			r.Cancel()
+		}
+	}
+
+	now := c.clock.Now()
+	combined := &Reservation{ok: true, timeToAct: now, clock: c.clock}
+	rejectedBy := -1
+	for i, r := range reservations {
+		d := r.decision
+		if !r.OK() {
+			combined.ok = false
+			d = Decision{Limit: c.limits[i].GetLimit()}
+		}
+		if r.DelayFrom(now) > 0 && rejectedBy < 0 {
+			rejectedBy = i
+		}
+		if r.OK() && r.timeToAct.After(combined.timeToAct) {
+			combined.timeToAct = r.timeToAct
+		}
+		combined.decision = mostRestrictive(combined.decision, d, i == 0)
+	}
+	if !combined.ok {
+		cancel()
+		return &Reservation{decision: combined.decision}, rejectedBy
+	}
+	combined.cancel = func(time.Time) { cancel() }
+	return combined, rejectedBy
+}
+
+// mostRestrictive combines the decisions of two limits, keeping the limit with
+// the fewest remaining requests and the latest reset
+func mostRestrictive(d, other Decision, first bool) Decision {
+	if first {
+		return other
+	}
+	if other.Remaining < d.Remaining {
+		d.Limit, d.Remaining = other.Limit, other.Remaining
+	}
+	if other.ResetAt.After(d.ResetAt) {
+		d.ResetAt = other.ResetAt
+	}
+	return d
+}
+
+// Unregister removes the state of the given id from every limit
+func (c *CompositeLimiter) Unregister(id string) {
+	for _, limit := range c.limits {
+		limit.Unregister(id)
+	}
+}
+
+// Stop stops every limit
+func (c *CompositeLimiter) Stop() {
+	for _, limit := range c.limits {
+		limit.Stop()
+	}
+}
+
+// Stats returns the stats of every limit, in order
+func (c *CompositeLimiter) Stats() interface{} {
+	stats := make([]interface{}, len(c.limits))
+	for i, limit := range c.limits {
+		stats[i] = limit.Stats()
+	}
+	return stats
+}
+
+// GetLimit returns the lowest limit
+func (c *CompositeLimiter) GetLimit() int {
+	limit := c.limits[0].GetLimit()
+	for _, l := range c.limits[1:] {
+		if l.GetLimit() < limit {
+			limit = l.GetLimit()
+		}
+	}
+	return limit
+}
+
+// CompositeConfig is the configuration for the composite limiter
+type CompositeConfig struct {
+	// Limits are the configurations of the limits, in order
+	Limits []RateConfig
+}
+
+// Parse parses the "limits" arg and populates the CompositeConfig. The limits
+// are separated by ";", each is the algorithm followed by its comma separated
+// args, e.g.
+//
+//	token_bucket:capacity=10,refill_rate=10;fixed_window_counter:max_request_count=1000,window_size=24h
+//
+// The per-key state storage args (idle_ttl, max_keys, shards) are passed on
+// to every limit that does not set them.
+func (cc *CompositeConfig) Parse(config RateConfig) error {
+	cc.Limits = nil
+	for _, spec := range strings.Split(config["limits"], ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		algo, args, _ := strings.Cut(spec, ":")
+		limit := RateConfig{"algo": strings.TrimSpace(algo)}
+		for _, arg := range strings.Split(args, ",") {
+			if strings.TrimSpace(arg) == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				return fmt.Errorf("limit %q: expected key=value, got %q", spec, arg)
+			}
+			limit[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+		for _, key := range []string{"idle_ttl", "max_keys", "shards"} {
+			if _, ok := limit[key]; !ok && config[key] != "" {
+				limit[key] = config[key]
+			}
+		}
+		cc.Limits = append(cc.Limits, limit)
+	}
+	if len(cc.Limits) == 0 {
+		return fmt.Errorf("limits must name at least one limit")
+	}
+	return nil
+}
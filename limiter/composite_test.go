@@ -0,0 +1,141 @@
+package limiter
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCompositeAllOrNothing(t *testing.T) {
+	limiter, clock := newFakeClockLimiter(RateConfig{
+		"algo":   "composite",
+		"limits": "token_bucket:capacity=2,refill_rate=1; fixed_window_counter:max_request_count=3,window_size=1m",
+	})
+	defer limiter.Stop()
+	composite := limiter.(*CompositeLimiter)
+
+	for i := 0; i < 2; i++ {
+		if err := composite.Allow("user"); err != nil {
+			t.Fatalf("request %d: expected to be allowed, got %v", i, err)
+		}
+	}
+	// the bucket is empty, the window must not count the rejected request
+	d, rejectedBy := composite.Evaluate("user", 1)
+	if d.Allowed || rejectedBy != 0 || d.RetryAfter != time.Second {
+		t.Fatalf("expected the bucket to reject for 1s, got %d, %+v", rejectedBy, d)
+	}
+	if err := composite.Allow("user"); !errors.Is(err, ErrLimitRejected) {
+		t.Fatalf("expected ErrLimitRejected, got %v", err)
+	}
+
+	clock.Advance(time.Second)
+	if err := composite.Allow("user"); err != nil {
+		t.Fatalf("expected the third request of the window to be allowed, got %v", err)
+	}
+
+	// the bucket has a token again, but the window is full for another 58s
+	clock.Advance(time.Second)
+	d, rejectedBy = composite.Evaluate("user", 1)
+	if d.Allowed || rejectedBy != 1 || d.RetryAfter != 58*time.Second {
+		t.Fatalf("expected the window to reject for 58s, got %d, %+v", rejectedBy, d)
+	}
+	if d := composite.limits[0].Decide("user"); !d.Allowed {
+		t.Fatalf("expected the token to be handed back to the bucket, got %+v", d)
+	}
+}
+
+func TestCompositeLongestRetryAfter(t *testing.T) {
+	limiter, _ := newFakeClockLimiter(RateConfig{
+		"algo":   "composite",
+		"limits": "token_bucket:capacity=1,refill_rate=1;token_bucket:capacity=1,refill_rate=0.1",
+	})
+	defer limiter.Stop()
+
+	_ = limiter.Allow("user")
+	d, rejectedBy := limiter.(*CompositeLimiter).Evaluate("user", 1)
+	if rejectedBy != 0 || d.RetryAfter != 10*time.Second {
+		t.Fatalf("expected the first limit to reject and the second to wait longest, got %d, %+v", rejectedBy, d)
+	}
+}
+
+func TestCompositeRequiresReservations(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a limit without reservations to be refused")
+		}
+	}()
+	NewRateLimiterFromConfig(RateConfig{"algo": "composite", "limits": "gcra:capacity=1,refill_rate=1"})
+}
+
+func TestCompositeStopsLimitsOnError(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for _, limits := range []string{
+		"token_bucket:capacity=1,refill_rate=1; token_bucket:capacity=x,refill_rate=1",
+		"token_bucket:capacity=1,refill_rate=1; gcra:capacity=1,refill_rate=1",
+	} {
+		if _, err := NewRateLimiter(RateConfig{"algo": "composite", "limits": limits}); err == nil {
+			t.Fatalf("%s: expected an error", limits)
+		}
+	}
+
+	// the janitors of the limits built before the failing one are stopped
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("expected %d goroutines, got %d", before, n)
+	}
+}
+
+// gatedLimiter blocks the reservations of more than one request until
+// released, leaving the limits before it reserved in the meantime
+type gatedLimiter struct {
+	BlockingRateLimiter
+	reserving, release chan struct{}
+}
+
+func (g *gatedLimiter) ReserveN(id string, n int) *Reservation {
+	if n > 1 {
+		g.reserving <- struct{}{}
+		<-g.release
+	}
+	return g.BlockingRateLimiter.ReserveN(id, n)
+}
+
+func TestCompositeConcurrentRejections(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket := NewRateLimiterFromConfig(RateConfig{"algo": "token_bucket", "capacity": "10", "refill_rate": "1"}, WithClock(clock))
+	defer bucket.Stop()
+	gated := &gatedLimiter{
+		BlockingRateLimiter: NewRateLimiterFromConfig(RateConfig{"algo": "token_bucket", "capacity": "100", "refill_rate": "1"}, WithClock(clock)).(BlockingRateLimiter),
+		reserving:           make(chan struct{}),
+		release:             make(chan struct{}),
+	}
+	defer gated.Stop()
+	composite, err := NewCompositeLimiter([]BlockingRateLimiter{bucket.(BlockingRateLimiter), gated}, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.(*TBLimiter).AllowN("user", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	// a request too large for the 5 tokens left puts the bucket in debt until
+	// it is rejected, which must not reject the requests made meanwhile
+	rejected := make(chan error)
+	go func() { rejected <- composite.AllowN("user", 8) }()
+	<-gated.reserving
+	allowed := make(chan error)
+	go func() { allowed <- composite.Allow("user") }()
+	time.Sleep(10 * time.Millisecond)
+	close(gated.release)
+
+	if err := <-rejected; !errors.Is(err, ErrLimitRejected) {
+		t.Fatalf("expected ErrLimitRejected, got %v", err)
+	}
+	if err := <-allowed; err != nil {
+		t.Fatalf("expected one of the 5 tokens left, got %v", err)
+	}
+}
@@ -0,0 +1,530 @@
+package limiter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of the rate limiter server, loaded from a YAML
+// or JSON file with a limiter and a server section. The fields are named
+// after the flags, which override them.
+type Config struct {
+	Limiter LimiterConfig
+	Server  ServerConfig
+}
+
+// LimiterConfig is the typed RateConfig of a limiter. The optional fields are
+// left to the algorithm's default while zero.
+type LimiterConfig struct {
+	Algo string `flag:"algo"`
+
+	/*token bucket*/
+	Capacity   int     `flag:"capacity"`
+	RefillRate float64 `flag:"refill_rate"`
+
+	/*fixed window counter, sliding window counter and sliding window log*/
+	MaxRequestCount int      `flag:"max_request_count"`
+	RequestPerSec   int      `flag:"request_per_sec"`
+	WindowSize      Duration `flag:"window_size"`
+
+	/*leaky bucket*/
+	LeakRate     float64  `flag:"leak_rate"`
+	LeakyMode    string   `flag:"leaky_mode"`
+	QueueTimeout Duration `flag:"queue_timeout"`
+
+	/*concurrency*/
+	MaxInFlight       int `flag:"max_in_flight"`
+	GlobalMaxInFlight int `flag:"global_max_in_flight"`
+
+	/*adaptive*/
+	MinRate          float64  `flag:"min_rate,optional"`
+	MaxRate          float64  `flag:"max_rate,optional"`
+	RateIncrease     float64  `flag:"rate_increase,optional"`
+	RateDecrease     float64  `flag:"rate_decrease,optional"`
+	TargetLatency    Duration `flag:"target_latency,optional"`
+	LatencySmoothing float64  `flag:"latency_smoothing,optional"`
+	AdjustInterval   Duration `flag:"adjust_interval,optional"`
+
+	/*quota*/
+	Quota       int    `flag:"quota"`
+	QuotaPeriod string `flag:"quota_period"`
+	MaxQuotas   int    `flag:"max_quotas"`
+	Timezone    string `flag:"timezone"`
+
+	/*hierarchical*/
+	UserCapacity     int     `flag:"user_capacity"`
+	UserRefillRate   float64 `flag:"user_refill_rate"`
+	OrgCapacity      int     `flag:"org_capacity,optional"`
+	OrgRefillRate    float64 `flag:"org_refill_rate,optional"`
+	GlobalCapacity   int     `flag:"global_capacity,optional"`
+	GlobalRefillRate float64 `flag:"global_refill_rate,optional"`
+	Sharing          string  `flag:"sharing"`
+
+	/*priority*/
+	CriticalReserve float64 `flag:"critical_reserve"`
+	DefaultReserve  float64 `flag:"default_reserve"`
+
+	/*fair queue*/
+	QueueSize     int            `flag:"queue_size"`
+	MaxWait       Duration       `flag:"max_wait"`
+	Weights       map[string]int `flag:"weights,optional"`
+	DefaultWeight int            `flag:"default_weight"`
+
+	/*composite*/
+	Limits string `flag:"limits,optional"`
+
+	/*penalty box*/
+	BanThreshold   int      `flag:"ban_threshold"`
+	BanWindow      Duration `flag:"ban_window"`
+	BanDuration    Duration `flag:"ban_duration"`
+	BanMultiplier  float64  `flag:"ban_multiplier"`
+	MaxBanDuration Duration `flag:"max_ban_duration"`
+
+	/*per-key state storage*/
+	IdleTTL Duration `flag:"idle_ttl"`
+	MaxKeys int      `flag:"max_keys"`
+	Shards  int      `flag:"shards"`
+}
+
+// ServerConfig configures the test server
+type ServerConfig struct {
+	Address string `flag:"address"`
+	// AdminAddress is the address of the admin routes, not served if empty
+	AdminAddress string `flag:"admin_address,optional"`
+	// Key is the spec of the key extractor, see keys.Parse
+	Key string `flag:"key"`
+	// OrgKey is the spec of the extractor of the organisation, for the
+	// hierarchical limiter
+	OrgKey         string   `flag:"org_key,optional"`
+	TrustedProxies []string `flag:"trusted_proxies,optional"`
+	JWTSecret      string   `flag:"jwt_secret,optional"`
+	LegacyHeaders  bool     `flag:"legacy_headers"`
+	// AccessList and Rules are the paths of the access list and rules files
+	AccessList string `flag:"access_list,optional"`
+	Rules      string `flag:"rules,optional"`
+}
+
+// Duration is a time.Duration, written as in "1s" or "5m"
+type Duration time.Duration
+
+func (d Duration) String() string { return time.Duration(d).String() }
+
+// DefaultConfig returns the configuration with the defaults of the flags
+func DefaultConfig() *Config {
+	return &Config{
+		Limiter: LimiterConfig{
+			Algo:            "token_bucket",
+			Capacity:        10,
+			RefillRate:      1,
+			MaxRequestCount: 10,
+			RequestPerSec:   10,
+			WindowSize:      Duration(time.Second),
+			LeakRate:        1,
+			LeakyMode:       LeakyMeter,
+			MaxInFlight:     10,
+			Quota:           10000,
+			QuotaPeriod:     QuotaMonth,
+			MaxQuotas:       DefaultMaxQuotas,
+			Timezone:        "UTC",
+			UserCapacity:    10,
+			UserRefillRate:  1,
+			Sharing:         SharingStrict,
+			CriticalReserve: 0.2,
+			DefaultReserve:  0.3,
+			QueueSize:       100,
+			MaxWait:         Duration(DefaultMaxWait),
+			DefaultWeight:   1,
+			BanWindow:       Duration(time.Minute),
+			BanDuration:     Duration(time.Minute),
+			BanMultiplier:   2,
+			MaxBanDuration:  Duration(24 * time.Hour),
+			IdleTTL:         Duration(DefaultIdleTTL),
+			MaxKeys:         DefaultMaxKeys,
+			Shards:          DefaultShards,
+		},
+		Server: ServerConfig{
+			Address:      ":8080",
+			AdminAddress: "127.0.0.1:8081",
+			Key:          "header:X-User|ip",
+			OrgKey:       "header:X-Org",
+		},
+	}
+}
+
+// LoadConfig loads the configuration file at path over the defaults, as JSON
+// if it ends in .json and as YAML otherwise. Unknown fields are errors, to
+// catch typos. The config should be validated once the flags override it.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sections map[string]map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&sections)
+	} else {
+		err = yaml.Unmarshal(data, &sections)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	config := DefaultConfig()
+	var errs []string
+	for name, fields := range sections {
+		var section reflect.Value
+		switch name {
+		case "limiter":
+			section = reflect.ValueOf(&config.Limiter).Elem()
+		case "server":
+			section = reflect.ValueOf(&config.Server).Elem()
+		default:
+			errs = append(errs, name+": unknown section, expected limiter or server")
+			continue
+		}
+		for field, value := range fields {
+			s, err := configString(value)
+			if err == nil {
+				err = setField(section, field, s)
+			}
+			if err != nil {
+				errs = append(errs, name+"."+field+": "+err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s: %w", path, configErrors(errs))
+	}
+	return config, nil
+}
+
+// configErrors lists the errors of the fields of a config, sorted
+func configErrors(errs []string) error {
+	sort.Strings(errs)
+	return fmt.Errorf("invalid config:\n\t%s", strings.Join(errs, "\n\t"))
+}
+
+// configString writes the value of a field decoded from a file as the value
+// of its flag
+func configString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int, json.Number, bool:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := configString(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		pairs := make([]string, 0, len(v))
+		for key, item := range v {
+			s, err := configString(item)
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, key+"="+s)
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ","), nil
+	default:
+		return "", fmt.Errorf("unexpected value %v", value)
+	}
+}
+
+// algoFields are the fields the algorithms need to be positive. The others
+// may be 0, e.g. a capacity of 0 blocks every request and a refill rate of 0
+// never refills.
+var algoFields = map[string][]string{
+	"token_bucket":           {},
+	"gcra":                   {"refill_rate"},
+	"adaptive":               {"refill_rate"},
+	"priority":               {},
+	"fair_queue":             {"refill_rate", "default_weight"},
+	"fixed_window_counter":   {"window_size"},
+	"sliding_window_counter": {"window_size"},
+	"sliding_window_log":     {"window_size"},
+	"leaky_bucket":           {"leak_rate"},
+	"concurrency":            {},
+	"quota":                  {},
+	"hierarchical":           {},
+	"composite":              {},
+}
+
+// Validate checks the fields of the configuration, and returns an error
+// listing all the invalid ones
+func (c *Config) Validate() error {
+	var errs []string
+	invalid := func(field, format string, args ...interface{}) {
+		errs = append(errs, field+": "+fmt.Sprintf(format, args...))
+	}
+
+	l := &c.Limiter
+	required, ok := algoFields[l.Algo]
+	if !ok {
+		algos := make([]string, 0, len(algoFields))
+		for algo := range algoFields {
+			algos = append(algos, algo)
+		}
+		sort.Strings(algos)
+		invalid("limiter.algo", "expected one of %s, got %q", strings.Join(algos, ", "), l.Algo)
+	}
+
+	// no number may be negative, and the ones the algorithm needs must be positive
+	eachField(reflect.ValueOf(l).Elem(), func(name string, _ bool, v reflect.Value) {
+		var negative, zero bool
+		switch value := v.Interface().(type) {
+		case int:
+			negative, zero = value < 0, value == 0
+		case float64:
+			negative, zero = value < 0, value == 0
+		case Duration:
+			negative, zero = value < 0, value == 0
+		default:
+			return
+		}
+		if negative {
+			invalid("limiter."+name, "must not be negative, got %v", v.Interface())
+		} else if zero && contains(required, name) {
+			invalid("limiter."+name, "must be positive for %s", l.Algo)
+		}
+	})
+
+	// the enums and bounds are only checked for the algorithm using them
+	switch l.Algo {
+	case "leaky_bucket":
+		switch l.LeakyMode {
+		case LeakyMeter, LeakyQueue:
+		default:
+			invalid("limiter.leaky_mode", "expected %q or %q, got %q", LeakyMeter, LeakyQueue, l.LeakyMode)
+		}
+	case "quota":
+		switch l.QuotaPeriod {
+		case QuotaMinute, QuotaHour, QuotaDay, QuotaWeek, QuotaMonth:
+		default:
+			invalid("limiter.quota_period", "expected minute, hour, day, week or month, got %q", l.QuotaPeriod)
+		}
+		if _, err := time.LoadLocation(l.Timezone); err != nil {
+			invalid("limiter.timezone", "unknown timezone %q", l.Timezone)
+		}
+	case "hierarchical":
+		switch l.Sharing {
+		case SharingStrict, SharingBorrow:
+		default:
+			invalid("limiter.sharing", "expected %q or %q, got %q", SharingStrict, SharingBorrow, l.Sharing)
+		}
+	case "adaptive":
+		if l.RateDecrease >= 1 {
+			invalid("limiter.rate_decrease", "must be less than 1, got %v", l.RateDecrease)
+		}
+		if l.LatencySmoothing > 1 {
+			invalid("limiter.latency_smoothing", "must not be more than 1, got %v", l.LatencySmoothing)
+		}
+	case "priority":
+		if l.CriticalReserve+l.DefaultReserve > 1 {
+			invalid("limiter.default_reserve", "must not add up to more than 1 with critical_reserve, got %v",
+				l.CriticalReserve+l.DefaultReserve)
+		}
+	case "fair_queue":
+		for key, weight := range l.Weights {
+			if weight < 1 {
+				invalid("limiter.weights."+key, "must be positive, got %d", weight)
+			}
+		}
+	case "composite":
+		if strings.TrimSpace(l.Limits) == "" {
+			invalid("limiter.limits", "must name at least one limit for composite")
+		}
+	}
+	if l.BanMultiplier < 1 {
+		invalid("limiter.ban_multiplier", "must be at least 1, got %v", l.BanMultiplier)
+	}
+	if l.MaxBanDuration < l.BanDuration {
+		invalid("limiter.max_ban_duration", "must not be shorter than ban_duration, got %s", l.MaxBanDuration)
+	}
+
+	if c.Server.Address == "" {
+		invalid("server.address", "must not be empty")
+	}
+	if c.Server.Key == "" {
+		invalid("server.key", "must not be empty")
+	}
+
+	if len(errs) > 0 {
+		return configErrors(errs)
+	}
+	return nil
+}
+
+// RateConfig returns the args of the limiter, as NewRateLimiterFromConfig
+// takes them
+func (l *LimiterConfig) RateConfig() RateConfig {
+	config := RateConfig{}
+	eachField(reflect.ValueOf(l).Elem(), func(name string, optional bool, v reflect.Value) {
+		config[name] = flagValue(optional, v)
+	})
+	return config
+}
+
+// Flags returns the values of the fields of both sections, by flag name, as
+// Set takes them
+func (c *Config) Flags() map[string]string {
+	flags := map[string]string{}
+	for _, section := range []reflect.Value{reflect.ValueOf(&c.Limiter).Elem(), reflect.ValueOf(&c.Server).Elem()} {
+		eachField(section, func(name string, optional bool, v reflect.Value) {
+			flags[name] = flagValue(optional, v)
+		})
+	}
+	return flags
+}
+
+// flagValue writes the value of a field as the value of its flag, empty for
+// an optional field left to the algorithm's default
+func flagValue(optional bool, v reflect.Value) string {
+	if optional && v.IsZero() {
+		return ""
+	}
+	switch value := v.Interface().(type) {
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case []string:
+		return strings.Join(value, ",")
+	case map[string]int:
+		pairs := make([]string, 0, len(value))
+		for key, weight := range value {
+			pairs = append(pairs, key+"="+strconv.Itoa(weight))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// Set sets the field of the flag, in the limiter or server section, to the
+// value of the flag. Lists and weights are comma separated, as in
+// "alice=3,bob=2".
+func (c *Config) Set(name, value string) error {
+	err := setField(reflect.ValueOf(&c.Limiter).Elem(), name, value)
+	if errors.Is(err, errUnknownField) {
+		err = setField(reflect.ValueOf(&c.Server).Elem(), name, value)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+var errUnknownField = fmt.Errorf("unknown field")
+
+// setField parses the value into the field of the section named name
+func setField(section reflect.Value, name, value string) error {
+	var field reflect.Value
+	eachField(section, func(n string, _ bool, v reflect.Value) {
+		if n == name {
+			field = v
+		}
+	})
+	if !field.IsValid() {
+		return errUnknownField
+	}
+
+	// an empty value leaves an optional field to the algorithm's default
+	value = strings.TrimSpace(value)
+	if value == "" {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+	switch field.Addr().Interface().(type) {
+	case *Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("expected a duration such as 1s or 5m, got %q", value)
+		}
+		field.SetInt(int64(d))
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", value)
+		}
+		field.SetInt(int64(n))
+	case *float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", value)
+		}
+		field.SetFloat(f)
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", value)
+		}
+		field.SetBool(b)
+	case *string:
+		field.SetString(value)
+	case *[]string:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	case *map[string]int:
+		weights := map[string]int{}
+		for _, pair := range strings.Split(value, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			key, weight, ok := strings.Cut(pair, "=")
+			n, err := strconv.Atoi(strings.TrimSpace(weight))
+			if !ok || err != nil {
+				return fmt.Errorf("expected key=integer pairs, got %q", pair)
+			}
+			weights[strings.TrimSpace(key)] = n
+		}
+		field.Set(reflect.ValueOf(weights))
+	}
+	return nil
+}
+
+// eachField calls f with the flag name, whether it is optional and the value
+// of every field of the section
+func eachField(section reflect.Value, f func(name string, optional bool, v reflect.Value)) {
+	for i := 0; i < section.NumField(); i++ {
+		name, options, _ := strings.Cut(section.Type().Field(i).Tag.Get("flag"), ",")
+		f(name, options == "optional", section.Field(i))
+	}
+}
+
+// contains reports if the names contain the name
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package limiter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes the configuration file, named name, to a temporary
+// directory and returns its path
+func writeConfig(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	for name, data := range map[string]string{
+		"config.yaml": `
+limiter:
+  algo: fair_queue
+  capacity: 20
+  refill_rate: 2.5
+  max_wait: 5s
+  weights:
+    alice: 3
+server:
+  key: jwt:sub|ip
+  trusted_proxies: [10.0.0.0/8, 192.0.2.1]
+  legacy_headers: true
+`,
+		"config.json": `{
+	"limiter": {"algo": "fair_queue", "capacity": 20, "refill_rate": 2.5, "max_wait": "5s", "weights": {"alice": 3}},
+	"server": {"key": "jwt:sub|ip", "trusted_proxies": ["10.0.0.0/8", "192.0.2.1"], "legacy_headers": true}
+}`,
+	} {
+		config, err := LoadConfig(writeConfig(t, name, data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := config.Validate(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		l, s := config.Limiter, config.Server
+		if l.Algo != "fair_queue" || l.Capacity != 20 || l.RefillRate != 2.5 ||
+			l.MaxWait != Duration(5*time.Second) || l.Weights["alice"] != 3 {
+			t.Errorf("%s: unexpected limiter config %+v", name, l)
+		}
+		if s.Key != "jwt:sub|ip" || len(s.TrustedProxies) != 2 || !s.LegacyHeaders {
+			t.Errorf("%s: unexpected server config %+v", name, s)
+		}
+		// the fields missing from the file keep their defaults
+		if l.QueueSize != 100 || l.IdleTTL != Duration(DefaultIdleTTL) || s.Address != ":8080" {
+			t.Errorf("%s: expected the defaults, got %+v", name, config)
+		}
+
+		rc := l.RateConfig()
+		if rc["weights"] != "alice=3" || rc["max_wait"] != "5s" || rc["refill_rate"] != "2.5" || rc["min_rate"] != "" {
+			t.Errorf("%s: unexpected rate config %v", name, rc)
+		}
+		limiter, err := NewRateLimiter(rc)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		limiter.Stop()
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, "config.json", `{
+	"limiter": {"capacity": "ten", "window_size": 5, "capcity": 1},
+	"servr": {}
+}`))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{
+		`limiter.capacity: expected an integer, got "ten"`,
+		`limiter.window_size: expected a duration`,
+		`limiter.capcity: unknown field`,
+		`servr: unknown section`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to contain %q, got %v", want, err)
+		}
+	}
+
+	config := DefaultConfig()
+	config.Limiter.Algo = "leaky_bucket"
+	config.Limiter.LeakRate = 0
+	config.Limiter.LeakyMode = "drip"
+	config.Limiter.MaxKeys = -1
+	err = config.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{
+		"limiter.leak_rate: must be positive for leaky_bucket",
+		`limiter.leaky_mode: expected "meter" or "queue", got "drip"`,
+		"limiter.max_keys: must not be negative",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to contain %q, got %v", want, err)
+		}
+	}
+
+	// 0 blocks every request, and the fields of the other algorithms are not checked
+	config = DefaultConfig()
+	config.Limiter.Capacity = 0
+	config.Limiter.MaxRequestCount = 0
+	config.Limiter.LeakyMode = "drip"
+	config.Limiter.QuotaPeriod = "year"
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected the config to be valid, got %v", err)
+	}
+	blocked, err := NewRateLimiter(config.Limiter.RateConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocked.Stop()
+	if err := blocked.Allow("alice"); err == nil {
+		t.Error("expected a capacity of 0 to block every request")
+	}
+
+	// the algorithms name the invalid arg too
+	if _, err := NewRateLimiter(RateConfig{"algo": "fixed_window_counter", "max_request_count": "10", "window_size": "1"}); err == nil ||
+		!strings.Contains(err.Error(), "window_size") {
+		t.Errorf("expected an error naming window_size, got %v", err)
+	}
+	if _, err := NewRateLimiter(RateConfig{"algo": "tokenbucket"}); !errors.Is(err, ErrUnknownAlgo) {
+		t.Errorf("expected %v, got %v", ErrUnknownAlgo, err)
+	}
+}
+
+func TestConfigSet(t *testing.T) {
+	config := DefaultConfig()
+	for name, value := range map[string]string{
+		"algo":            "sliding_window_log",
+		"request_per_sec": "5",
+		"window_size":     "2s",
+		"min_rate":        "",
+		"weights":         "alice=3, bob=2",
+		"address":         ":9090",
+		"trusted_proxies": "10.0.0.0/8,",
+		"legacy_headers":  "true",
+	} {
+		if err := config.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, s := config.Limiter, config.Server
+	if l.Algo != "sliding_window_log" || l.RequestPerSec != 5 || l.WindowSize != Duration(2*time.Second) ||
+		l.Weights["bob"] != 2 || s.Address != ":9090" || len(s.TrustedProxies) != 1 || !s.LegacyHeaders {
+		t.Fatalf("unexpected config %+v", config)
+	}
+
+	for name, value := range map[string]string{
+		"capacity":       "ten",
+		"legacy_headers": "yes",
+		"weights":        "alice",
+		"refill":         "1",
+	} {
+		if err := config.Set(name, value); err == nil || !strings.HasPrefix(err.Error(), name+":") {
+			t.Errorf("%s=%s: expected an error naming the field, got %v", name, value, err)
+		}
+	}
+}
+
+func TestConfigFlags(t *testing.T) {
+	config := DefaultConfig()
+	for name, value := range map[string]string{
+		"weights":         "alice=3,bob=2",
+		"trusted_proxies": "10.0.0.0/8,192.168.0.0/16",
+		"max_wait":        "1m30s",
+	} {
+		if err := config.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the flags set a config back to the same values
+	flags, copied := config.Flags(), &Config{}
+	for name, value := range flags {
+		if err := copied.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(config, copied) {
+		t.Fatalf("expected %+v, got %+v", config, copied)
+	}
+	if flags["weights"] != "alice=3,bob=2" || flags["min_rate"] != "" || flags["address"] != ":8080" {
+		t.Fatalf("unexpected flags %v", flags)
+	}
+}
@@ -0,0 +1,34 @@
+package limiter
+
+import (
+	"math"
+	"time"
+)
+
+// maxWait is reported as the RetryAfter of a request that can never be
+// allowed (e.g. a limiter configured with a capacity of 0)
+const maxWait = time.Duration(math.MaxInt64)
+
+// Decision is the outcome of a rate limit check, along with the state of the
+// limiter for the key after the check.
+type Decision struct {
+	// Allowed is true if the request was admitted
+	Allowed bool `json:"allowed"`
+	// Limit is the maximum number of requests allowed by the limiter
+	Limit int `json:"limit"`
+	// Remaining is the number of requests that can still be made right now
+	Remaining int `json:"remaining"`
+	// ResetAt is the time at which the limiter is back to its full limit
+	ResetAt time.Time `json:"reset_at"`
+	// RetryAfter is the time to wait before the request can be allowed.
+	// It is 0 for allowed requests and maxWait if it can never be allowed.
+	RetryAfter time.Duration `json:"retry_after"`
+}
+
+// deadline returns now + d, or the zero time if d is maxWait
+func deadline(now time.Time, d time.Duration) time.Time {
+	if d == maxWait {
+		return time.Time{}
+	}
+	return now.Add(d)
+}
@@ -1,14 +1,51 @@
 package limiter
 
 import (
+	"fmt"
 	ccUtils "github.com/vamsaty/cc-utils"
-	"sync"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type RateConfig map[string]string
 
+// int parses the arg as an integer
+func (c RateConfig) int(key string) (int, error) {
+	value, err := strconv.Atoi(strings.TrimSpace(c[key]))
+	if err != nil {
+		return 0, fmt.Errorf("%s: expected an integer, got %q", key, c[key])
+	}
+	return value, nil
+}
+
+// float parses the arg as a number
+func (c RateConfig) float(key string) (float64, error) {
+	value, err := strconv.ParseFloat(strings.TrimSpace(c[key]), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: expected a number, got %q", key, c[key])
+	}
+	return value, nil
+}
+
+// duration parses the arg as a duration
+func (c RateConfig) duration(key string) (time.Duration, error) {
+	value, err := time.ParseDuration(strings.TrimSpace(c[key]))
+	if err != nil {
+		return 0, fmt.Errorf("%s: expected a duration such as 1s or 5m, got %q", key, c[key])
+	}
+	return value, nil
+}
+
+var (
+	ErrInvalidCost = fmt.Errorf("request cost must not be negative")
+	ErrUnknownAlgo = fmt.Errorf("unknown algo")
+)
+
 type RateLimiter interface {
 	Allow(string) error
+	AllowN(string, int) error
+	Decide(string) Decision
 	GetLimit() int
 	Unregister(string)
 	Stop()
@@ -23,42 +60,229 @@ const (
 	FixedWindowCounter
 )
 
-func NewRateLimiterFromConfig(config RateConfig) RateLimiter {
+// Option customizes the limiters created by NewRateLimiterFromConfig
+type Option func(*options)
+
+type options struct {
+	clock Clock
+}
+
+// WithClock makes the limiter tell the time with the given clock instead of
+// the real clock. Mostly useful in tests, with a FakeClock.
+func WithClock(clock Clock) Option {
+	return func(o *options) { o.clock = clock }
+}
+
+// NewRateLimiterFromConfig is NewRateLimiter, panicking on an invalid config
+func NewRateLimiterFromConfig(config RateConfig, opts ...Option) RateLimiter {
+	limiter, err := NewRateLimiter(config, opts...)
+	ccUtils.PanicIf(err)
+	return limiter
+}
+
+// NewRateLimiter creates the rate limiter of the config's algo, or returns
+// the error of an invalid config. It is wrapped in a PenaltyBox if the config
+// has a ban_threshold.
+func NewRateLimiter(config RateConfig, opts ...Option) (RateLimiter, error) {
+	pc := &PenaltyConfig{}
+	if err := pc.Parse(config); err != nil {
+		return nil, err
+	}
+	limiter, err := newRateLimiter(config, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if pc.Threshold > 0 {
+		return NewPenaltyBox(limiter, pc, opts...), nil
+	}
+	return limiter, nil
+}
+
+// newRateLimiter creates the rate limiter of the config's algo. The config is
+// parsed before any limiter is started, and the limiters started are stopped
+// if a later one fails.
+func newRateLimiter(config RateConfig, opts ...Option) (RateLimiter, error) {
+	o := &options{clock: RealClock()}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	keyStoreConfig := KeyStoreConfig{}
+	if err := keyStoreConfig.Parse(config); err != nil {
+		return nil, err
+	}
+
 	switch config["algo"] {
 
 	case "token_bucket":
 		tbc := &TokenBucketConfig{}
-		ccUtils.PanicIf(tbc.Parse(config))
+		if err := tbc.Parse(config); err != nil {
+			return nil, err
+		}
+
+		return newTBLimiter(tbc, keyStoreConfig, o.clock), nil
+
+	case "adaptive":
+		tbc := &TokenBucketConfig{}
+		if err := tbc.Parse(config); err != nil {
+			return nil, err
+		}
+		ac := &AdaptiveConfig{}
+		if err := ac.Parse(config); err != nil {
+			return nil, err
+		}
 
-		return &TBLimiter{
-			bucketMap: make(map[string]*tokenBucket),
-			RWMutex:   &sync.RWMutex{},
-			shutDown:  make(chan struct{}),
-			config:    tbc,
+		tbl := newTBLimiter(tbc, keyStoreConfig, o.clock)
+		a, err := newAdaptiveLimiter(tbl, ac)
+		if err != nil {
+			tbl.Stop()
+			return nil, err
 		}
+		return a, nil
 
 	case "fixed_window_counter":
 		winConfig := &WindowConfig{}
-		ccUtils.PanicIf(winConfig.Parse(config))
-
-		return &WindowLimiterImpl{
-			Mutex:     &sync.Mutex{},
-			windowMap: make(map[string]*window),
-			config:    winConfig,
+		if err := winConfig.Parse(config); err != nil {
+			return nil, err
 		}
 
+		w := &WindowLimiterImpl{config: winConfig, clock: o.clock}
+		w.windows = newKeyStore(keyStoreConfig, o.clock, w.newWindow)
+		return w, nil
+
 	case "sliding_window_log":
 
 		swlc := &SlidingWindowLogConfig{}
 		if err := swlc.Parse(config); err != nil {
-			panic(err)
+			return nil, err
 		}
-		return &SlidingWindowLogRateLimiter{
-			config: swlc,
-			swMap:  make(map[string]*slidingWindowLog),
+		swl := &SlidingWindowLogRateLimiter{config: swlc, clock: o.clock}
+		swl.logs = newKeyStore(keyStoreConfig, o.clock, swl.newLog)
+		return swl, nil
+
+	case "sliding_window_counter":
+		swcc := &SlidingWindowCounterConfig{}
+		if err := swcc.Parse(config); err != nil {
+			return nil, err
 		}
+
+		swc := &SlidingWindowCounterLimiter{config: swcc, clock: o.clock}
+		swc.counters = newKeyStore(keyStoreConfig, o.clock, swc.newCounter)
+		return swc, nil
+
+	case "gcra":
+		tbc := &TokenBucketConfig{}
+		if err := tbc.Parse(config); err != nil {
+			return nil, err
+		}
+
+		return newGCRALimiter(tbc, keyStoreConfig, o.clock)
+
+	case "leaky_bucket":
+		lbc := &LeakyBucketConfig{}
+		if err := lbc.Parse(config); err != nil {
+			return nil, err
+		}
+
+		lb := &LeakyBucketLimiter{config: lbc, clock: o.clock}
+		lb.buckets = newKeyStore(keyStoreConfig, o.clock, lb.newBucket)
+		return lb, nil
+
+	case "concurrency":
+		cc := &ConcurrencyConfig{}
+		if err := cc.Parse(config); err != nil {
+			return nil, err
+		}
+
+		cl := &ConcurrencyLimiter{config: cc, clock: o.clock}
+		cl.slots = newKeyStoreOnRemove(keyStoreConfig, o.clock, cl.newSlot, cl.release)
+		return cl, nil
+
+	case "quota":
+		qc := &QuotaConfig{}
+		if err := qc.Parse(config); err != nil {
+			return nil, err
+		}
+
+		// quotas are never evicted for new ids, max_quotas bounds them instead
+		quotaStoreConfig := keyStoreConfig
+		quotaStoreConfig.MaxKeys = qc.MaxQuotas
+		q := &QuotaLimiter{config: qc, clock: o.clock}
+		q.quotas = newKeyStore(quotaStoreConfig, o.clock, q.newQuota)
+		return q, nil
+
+	case "hierarchical":
+		hc := &HierarchicalConfig{}
+		if err := hc.Parse(config); err != nil {
+			return nil, err
+		}
+
+		h := &HierarchicalLimiter{config: hc, clock: o.clock}
+		for _, tbc := range []*TokenBucketConfig{hc.User, hc.Org, hc.Global} {
+			var level *TBLimiter
+			if tbc != nil {
+				level = newTBLimiter(tbc, keyStoreConfig, o.clock)
+			}
+			h.levels = append(h.levels, level)
+		}
+		return h, nil
+
+	case "priority":
+		pc := &PriorityConfig{}
+		if err := pc.Parse(config); err != nil {
+			return nil, err
+		}
+
+		return newPriorityLimiter(pc, o.clock), nil
+
+	case "fair_queue":
+		fc := &FairQueueConfig{}
+		if err := fc.Parse(config); err != nil {
+			return nil, err
+		}
+
+		return newFairQueueLimiter(fc, o.clock), nil
+
+	case "composite":
+		cc := &CompositeConfig{}
+		if err := cc.Parse(config); err != nil {
+			return nil, err
+		}
+
+		limits := make([]BlockingRateLimiter, 0, len(cc.Limits))
+		// stop the limits already started if one of them fails
+		stop := func() {
+			for _, limit := range limits {
+				limit.Stop()
+			}
+		}
+		for i, limitConfig := range cc.Limits {
+			limiter, err := NewRateLimiter(limitConfig, opts...)
+			if err != nil {
+				stop()
+				return nil, fmt.Errorf("limit %d: %w", i, err)
+			}
+			limit, ok := limiter.(BlockingRateLimiter)
+			if !ok {
+				limiter.Stop()
+				stop()
+				return nil, fmt.Errorf("limit %d: %q does not support reservations", i, limitConfig["algo"])
+			}
+			limits = append(limits, limit)
+		}
+		c, err := NewCompositeLimiter(limits, opts...)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		return c, nil
+
+	// without an algo, nothing is rate limited
+	case "":
+		return &DummyRateLimit{}, nil
+
 	default:
-		return &DummyRateLimit{}
+		return nil, fmt.Errorf("%w %q", ErrUnknownAlgo, config["algo"])
 	}
 }
 
@@ -70,3 +294,14 @@ func (d *DummyRateLimit) Unregister(_ string)  {}
 func (d *DummyRateLimit) Stop()                {}
 func (d *DummyRateLimit) Stats() interface{}   { return nil }
 func (d *DummyRateLimit) GetLimit() int        { return 1e9 }
+
+func (d *DummyRateLimit) AllowN(_ string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	return nil
+}
+
+func (d *DummyRateLimit) Decide(_ string) Decision {
+	return Decision{Allowed: true, Limit: d.GetLimit(), Remaining: d.GetLimit(), ResetAt: time.Now()}
+}
@@ -0,0 +1,115 @@
+package limiter
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// queueRequests makes a request per key, one after the other, each once the
+// previous one is queued. The keys are sent on served as their requests return.
+func queueRequests(t *testing.T, limiter *FairQueueLimiter, keys []string, served chan<- string) {
+	t.Helper()
+	for _, key := range keys {
+		queued := limiter.Stats().(map[string]interface{})["queued"].(int)
+		go func(key string) {
+			if err := limiter.Allow(key); err != nil {
+				t.Errorf("%s: expected the request to be served, got %v", key, err)
+			}
+			served <- key
+		}(key)
+		for limiter.Stats().(map[string]interface{})["queued"].(int) == queued {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestFairQueueRoundRobin(t *testing.T) {
+	rl, clock := newFakeClockLimiter(RateConfig{
+		"algo": "fair_queue", "capacity": "1", "refill_rate": "1", "weights": "alice=2",
+	})
+	defer rl.Stop()
+	limiter := rl.(*FairQueueLimiter)
+
+	if err := limiter.Allow("carol"); err != nil {
+		t.Fatalf("expected the first request to be allowed right away, got %v", err)
+	}
+	served := make(chan string, 6)
+	queueRequests(t, limiter, []string{"bob", "bob", "alice", "alice", "alice", "alice"}, served)
+
+	var order []string
+	for len(order) < 6 {
+		for clock.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(time.Second)
+		order = append(order, <-served)
+	}
+	// alice gets twice the turns of bob, although bob queued first
+	want := []string{"bob", "alice", "alice", "bob", "alice", "alice"}
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("expected the requests to be served as %v, got %v", want, order)
+	}
+}
+
+func TestFairQueueBounds(t *testing.T) {
+	rl, clock := newFakeClockLimiter(RateConfig{
+		"algo": "fair_queue", "capacity": "1", "refill_rate": "0.1", "queue_size": "1", "max_wait": "1s",
+	})
+	defer rl.Stop()
+	limiter := rl.(*FairQueueLimiter)
+
+	if err := limiter.Allow("alice"); err != nil {
+		t.Fatalf("expected the first request to be allowed right away, got %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- limiter.Allow("alice") }()
+	// the dispatcher waits for a token, the request for its max wait
+	for clock.Waiters() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := limiter.Allow("bob"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+	stats := limiter.Stats().(map[string]interface{})
+	if keys := stats["keys"].(map[string]interface{}); stats["queued"] != 1 || len(keys) != 1 {
+		t.Fatalf("expected alice's request to be queued, got %v", stats)
+	}
+
+	clock.Advance(time.Second)
+	if err := <-done; !errors.Is(err, ErrMaxWaitExceeded) {
+		t.Fatalf("expected ErrMaxWaitExceeded, got %v", err)
+	}
+	if queued := limiter.Stats().(map[string]interface{})["queued"]; queued != 0 {
+		t.Fatalf("expected the queue to be empty, got %v", queued)
+	}
+}
+
+func TestFairQueueStop(t *testing.T) {
+	rl, clock := newFakeClockLimiter(RateConfig{
+		"algo": "fair_queue", "capacity": "1", "refill_rate": "1",
+	})
+	limiter := rl.(*FairQueueLimiter)
+
+	limiter.Allow("alice")
+	done := make(chan error, 1)
+	go func() { done <- limiter.Allow("alice") }()
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	limiter.Stop()
+	if err := <-done; !errors.Is(err, ErrLimiterStopped) {
+		t.Fatalf("expected ErrLimiterStopped, got %v", err)
+	}
+	// nothing is queued once stopped, there is no dispatcher left to serve it
+	go func() { done <- limiter.Allow("alice") }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrLimiterStopped) {
+			t.Fatalf("expected ErrLimiterStopped, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the request not to wait once the limiter is stopped")
+	}
+}
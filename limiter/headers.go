@@ -0,0 +1,82 @@
+package limiter
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Windowed is a RateLimiter whose limit applies over a window of time, e.g.
+// the window of a window counter or the time an empty token bucket takes to
+// refill
+type Windowed interface {
+	Window() time.Duration
+}
+
+// Policy describes the limits of the limiter as the value of the
+// RateLimit-Policy header, e.g. "10;w=1" for 10 requests per second, or ""
+// if the limiter does not limit requests over time.
+func Policy(limiter RateLimiter) string {
+	switch l := limiter.(type) {
+	case *CompositeLimiter:
+		policies := make([]string, 0, len(l.limits))
+		for _, limit := range l.limits {
+			if policy := Policy(limit); policy != "" {
+				policies = append(policies, policy)
+			}
+		}
+		return strings.Join(policies, ", ")
+	case Windowed:
+		if window := l.Window(); window > 0 {
+			return fmt.Sprintf("%d;w=%d", limiter.GetLimit(), seconds(window))
+		}
+	case interface{ Unwrap() RateLimiter }:
+		return Policy(l.Unwrap())
+	}
+	return ""
+}
+
+// SetHeaders sets the IETF RateLimit-Limit, RateLimit-Remaining,
+// RateLimit-Reset and RateLimit-Policy headers describing the decision, and
+// Retry-After if the request was rejected. RateLimit-Reset and Retry-After
+// are in seconds from now. With legacy, the X-RateLimit-Limit,
+// X-RateLimit-Remaining and X-RateLimit-Reset (in seconds since the epoch)
+// headers are set as well.
+func SetHeaders(h http.Header, d Decision, policy string, now time.Time, legacy bool) {
+	h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	if !d.ResetAt.IsZero() {
+		reset := 0
+		if d.ResetAt.After(now) {
+			reset = seconds(d.ResetAt.Sub(now))
+		}
+		h.Set("RateLimit-Reset", strconv.Itoa(reset))
+	}
+	if policy != "" {
+		h.Set("RateLimit-Policy", policy)
+	}
+	// no Retry-After for requests that can never be allowed
+	if !d.Allowed && d.RetryAfter != maxWait {
+		h.Set("Retry-After", strconv.Itoa(seconds(d.RetryAfter)))
+	}
+
+	if legacy {
+		h.Set("X-RateLimit-Limit", strconv.Itoa(d.Limit))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(d.Remaining))
+		if !d.ResetAt.IsZero() {
+			h.Set("X-RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(float64(d.ResetAt.UnixNano())/1e9)), 10))
+		}
+	}
+}
+
+// seconds rounds the duration up to whole seconds, as the headers have no
+// fractions of seconds. Waiting less than the duration would be too early.
+func seconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,56 @@
+package limiter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		config RateConfig
+		want   string
+	}{
+		{RateConfig{"algo": "token_bucket", "capacity": "10", "refill_rate": "2"}, "10;w=5"},
+		{RateConfig{"algo": "fixed_window_counter", "max_request_count": "100", "window_size": "1m"}, "100;w=60"},
+		{RateConfig{"algo": "quota", "quota": "1000", "quota_period": "day"}, "1000;w=86400"},
+		{RateConfig{"algo": "concurrency", "max_in_flight": "3"}, ""},
+		{RateConfig{
+			"algo":   "composite",
+			"limits": "token_bucket:capacity=10,refill_rate=10;fixed_window_counter:max_request_count=1000,window_size=24h",
+		}, "10;w=1, 1000;w=86400"},
+		// wrappers report the policy of the limiter they wrap
+		{RateConfig{"algo": "token_bucket", "capacity": "10", "refill_rate": "1", "ban_threshold": "5"}, "10;w=10"},
+	} {
+		limiter, _ := newFakeClockLimiter(tc.config)
+		if got := Policy(limiter); got != tc.want {
+			t.Errorf("%s: expected the policy %q, got %q", tc.config["algo"], tc.want, got)
+		}
+		limiter.Stop()
+	}
+}
+
+func TestServerRateLimitHeaders(t *testing.T) {
+	limiter, clock := newFakeClockLimiter(RateConfig{"algo": "token_bucket", "capacity": "2", "refill_rate": "0.5"})
+	server := NewServer(limiter, WithClock(clock))
+	server.LegacyHeaders = true
+	handler := server.Handler()
+
+	for i, want := range []map[string]string{
+		{"RateLimit-Limit": "2", "RateLimit-Remaining": "1", "RateLimit-Reset": "2", "RateLimit-Policy": "2;w=4", "Retry-After": ""},
+		{"RateLimit-Limit": "2", "RateLimit-Remaining": "0", "RateLimit-Reset": "4", "Retry-After": ""},
+		{"RateLimit-Remaining": "0", "RateLimit-Reset": "4", "Retry-After": "2",
+			"X-RateLimit-Limit": "2", "X-RateLimit-Remaining": "0",
+			"X-RateLimit-Reset": strconv.FormatInt(clock.Now().Add(4*time.Second).Unix(), 10)},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/limited", nil))
+		for header, value := range want {
+			if got := rec.Header().Get(header); got != value {
+				t.Errorf("request %d: expected %s to be %q, got %q", i, header, value, got)
+			}
+		}
+	}
+}
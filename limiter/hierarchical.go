@@ -0,0 +1,200 @@
+package limiter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// SharingStrict makes a request fit in the user, org and global limits
+	SharingStrict = "strict"
+	// SharingBorrow lets a level over its limit borrow the unused capacity of
+	// the level above it
+	SharingBorrow = "borrow"
+)
+
+// hierarchyLevels are the names of the levels of a HierarchicalLimiter
+var hierarchyLevels = []string{"user", "org", "global"}
+
+// HierarchicalLimiter checks a request against a token bucket of the user,
+// one of the user's organisation and a global one. Keys are "org/user", a key
+// without an organisation belongs to the "" organisation.
+//
+// With strict sharing, a request is allowed if every level allows it, so one
+// user can not use more than its limit of the organisation's allowance, and
+// one organisation not more than its limit of the global one. With borrow
+// sharing, a level over its limit may still let the request through if the
+// level above it allows it (the request borrows the parent's unused
+// capacity). The global level never borrows. A request is only charged to
+// the levels that allowed it.
+type HierarchicalLimiter struct {
+	// levels are the user, org and global limiters. The org and global
+	// limiters are nil if the level is not limited.
+	levels []*TBLimiter
+	config *HierarchicalConfig
+	clock  Clock
+}
+
+// Allow checks if a request can be allowed
+func (h *HierarchicalLimiter) Allow(key string) error {
+	return h.AllowN(key, 1)
+}
+
+// AllowN checks if a request costing n tokens can be allowed. The error names
+// the level that rejected it.
+func (h *HierarchicalLimiter) AllowN(key string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	if _, rejectedBy := h.Evaluate(key, n); rejectedBy != "" {
+		return fmt.Errorf("%w: %s", ErrLimitRejected, rejectedBy)
+	}
+	return nil
+}
+
+// Decide checks if a request can be allowed and reports the state of the most
+// restrictive level
+func (h *HierarchicalLimiter) Decide(key string) Decision {
+	d, _ := h.Evaluate(key, 1)
+	return d
+}
+
+// Evaluate checks if a request costing n tokens can be allowed. It returns the
+// name of the lowest level that rejected it, or "" if it was allowed.
+func (h *HierarchicalLimiter) Evaluate(key string, n int) (Decision, string) {
+	keys := h.keys(key)
+	reservations := make([]*Reservation, len(h.levels))
+	for i, level := range h.levels {
+		if level != nil {
+			reservations[i] = level.ReserveN(keys[i], n)
+		}
+	}
+
+	now := h.clock.Now()
+	delay := func(i int) time.Duration {
+		if reservations[i] == nil {
+			return 0
+		}
+		return reservations[i].DelayFrom(now)
+	}
+	// fits reports if the level i lets the request through, on its own or by
+	// borrowing from the level above it
+	fits := func(i int) (bool, time.Duration) {
+		wait := delay(i)
+		if h.config.Sharing == SharingBorrow && i+1 < len(h.levels) && h.levels[i+1] != nil {
+			if parent := delay(i + 1); parent < wait {
+				wait = parent
+			}
+		}
+		return wait == 0, wait
+	}
+
+	var d Decision
+	first, rejectedBy := true, ""
+	for i := range h.levels {
+		ok, wait := fits(i)
+		if !ok && rejectedBy == "" {
+			rejectedBy = hierarchyLevels[i]
+		}
+		if wait > d.RetryAfter {
+			d.RetryAfter = wait
+		}
+		if reservations[i] != nil {
+			d = mostRestrictive(d, reservations[i].decision, first)
+			first = false
+		}
+	}
+	if d.RetryAfter < 0 {
+		d.RetryAfter = 0
+	}
+
+	for i, r := range reservations {
+		// only the levels that allowed the request are charged
+		if r != nil && (rejectedBy != "" || delay(i) > 0) {
+			r.Cancel()
+		}
+	}
+	if rejectedBy != "" {
+		return d, rejectedBy
+	}
+	d.Allowed, d.RetryAfter = true, 0
+	return d, ""
+}
+
+// keys returns the keys of the user, org and global levels for the key
+func (h *HierarchicalLimiter) keys(key string) []string {
+	org, _, found := strings.Cut(key, "/")
+	if !found {
+		org = ""
+	}
+	return []string{key, org, ""}
+}
+
+// Unregister removes the user's state. The organisation's state is kept, as
+// it is shared with the other users of the organisation.
+func (h *HierarchicalLimiter) Unregister(key string) { h.levels[0].Unregister(key) }
+
+// Stop stops the limiters of every level
+func (h *HierarchicalLimiter) Stop() {
+	for _, level := range h.levels {
+		if level != nil {
+			level.Stop()
+		}
+	}
+}
+
+// Stats returns the stats of every level, by the level's name
+func (h *HierarchicalLimiter) Stats() interface{} {
+	stats := make(map[string]interface{})
+	for i, level := range h.levels {
+		if level != nil {
+			stats[hierarchyLevels[i]] = level.Stats()
+		}
+	}
+	return stats
+}
+
+// GetLimit returns the capacity of a user
+func (h *HierarchicalLimiter) GetLimit() int { return h.levels[0].GetLimit() }
+
+// Window returns the time it takes the empty bucket of a user to refill
+func (h *HierarchicalLimiter) Window() time.Duration { return h.levels[0].Window() }
+
+// HierarchicalConfig is the configuration for the hierarchical limiter
+type HierarchicalConfig struct {
+	// User, Org and Global are the bucket configurations of the levels. Org
+	// and Global are nil if the level is not limited.
+	User, Org, Global *TokenBucketConfig
+	// Sharing is either SharingStrict or SharingBorrow
+	Sharing string
+}
+
+// Parse parses the args and populates the HierarchicalConfig. The buckets of
+// the levels are configured by the <level>_capacity and <level>_refill_rate
+// args, the org and global levels are optional.
+func (hc *HierarchicalConfig) Parse(config RateConfig) error {
+	levels := []**TokenBucketConfig{&hc.User, &hc.Org, &hc.Global}
+	for i, name := range hierarchyLevels {
+		*levels[i] = nil
+		capacity, rate := config[name+"_capacity"], config[name+"_refill_rate"]
+		if i > 0 && capacity == "" && rate == "" {
+			continue
+		}
+		tbc := &TokenBucketConfig{}
+		if err := tbc.Parse(RateConfig{"capacity": capacity, "refill_rate": rate}); err != nil {
+			return fmt.Errorf("%s level: %w", name, err)
+		}
+		*levels[i] = tbc
+	}
+
+	hc.Sharing = config["sharing"]
+	switch hc.Sharing {
+	case "":
+		hc.Sharing = SharingStrict
+	case SharingStrict, SharingBorrow:
+	default:
+		return fmt.Errorf("sharing must be %q or %q, got %q", SharingStrict, SharingBorrow, hc.Sharing)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package limiter
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// allowSteps makes one request per step and checks the level rejecting it
+func allowSteps(t *testing.T, limiter *HierarchicalLimiter, steps []struct{ key, rejectedBy string }) {
+	t.Helper()
+	for i, s := range steps {
+		if _, rejectedBy := limiter.Evaluate(s.key, 1); rejectedBy != s.rejectedBy {
+			t.Fatalf("step %d (%s): expected rejection by %q, got %q", i, s.key, s.rejectedBy, rejectedBy)
+		}
+	}
+}
+
+func TestHierarchicalStrict(t *testing.T) {
+	limiter, _ := newFakeClockLimiter(RateConfig{
+		"algo":          "hierarchical",
+		"user_capacity": "2", "user_refill_rate": "0.001",
+		"org_capacity": "3", "org_refill_rate": "0.001",
+		"global_capacity": "4", "global_refill_rate": "0.001",
+	})
+	defer limiter.Stop()
+
+	allowSteps(t, limiter.(*HierarchicalLimiter), []struct{ key, rejectedBy string }{
+		{"acme/alice", ""},
+		{"acme/alice", ""},
+		{"acme/alice", "user"},
+		// alice used 2 of acme's 3
+		{"acme/bob", ""},
+		{"acme/bob", "org"},
+		// acme used 3 of the global 4
+		{"umbrella/carol", ""},
+		{"umbrella/carol", "global"},
+		{"dave", "global"},
+	})
+	if err := limiter.Allow("acme/bob"); !errors.Is(err, ErrLimitRejected) {
+		t.Fatalf("expected ErrLimitRejected, got %v", err)
+	}
+}
+
+func TestHierarchicalNoOrg(t *testing.T) {
+	limiter, _ := newFakeClockLimiter(RateConfig{
+		"algo":          "hierarchical",
+		"user_capacity": "2", "user_refill_rate": "0.001",
+		"org_capacity": "2", "org_refill_rate": "0.001",
+	})
+	defer limiter.Stop()
+
+	// users without an organisation share the bucket of the "" organisation
+	allowSteps(t, limiter.(*HierarchicalLimiter), []struct{ key, rejectedBy string }{
+		{"alice", ""},
+		{"bob", ""},
+		{"carol", "org"},
+		{"acme/carol", ""},
+	})
+}
+
+func TestHierarchicalBorrow(t *testing.T) {
+	limiter, _ := newFakeClockLimiter(RateConfig{
+		"algo":          "hierarchical",
+		"sharing":       "borrow",
+		"user_capacity": "1", "user_refill_rate": "0.001",
+		"org_capacity": "3", "org_refill_rate": "0.001",
+		"global_capacity": "10", "global_refill_rate": "0.001",
+	})
+	defer limiter.Stop()
+
+	allowSteps(t, limiter.(*HierarchicalLimiter), []struct{ key, rejectedBy string }{
+		{"acme/alice", ""},
+		// alice borrows acme's unused capacity
+		{"acme/alice", ""},
+		{"acme/alice", ""},
+		{"acme/alice", "user"},
+		// bob still gets his own share, borrowed from the global capacity
+		{"acme/bob", ""},
+		{"acme/bob", "user"},
+	})
+}
+
+func TestHierarchicalOverHTTP(t *testing.T) {
+	limiter, _ := newFakeClockLimiter(RateConfig{
+		"algo":          "hierarchical",
+		"user_capacity": "1", "user_refill_rate": "0.001",
+		"org_capacity": "2", "org_refill_rate": "0.001",
+	})
+	handler := NewServer(limiter).Handler()
+
+	for i, want := range []int{200, 200, 429} {
+		req := httptest.NewRequest(http.MethodGet, "/limited", nil)
+		req.Header.Set("X-Org", "acme")
+		req.Header.Set("X-User", []string{"alice", "bob", "carol"}[i])
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("request %d: expected %d, got %d", i, want, rec.Code)
+		}
+	}
+}
+
+func TestServerOrgOnlyForHierarchical(t *testing.T) {
+	limiter, _ := newFakeClockLimiter(RateConfig{"algo": "token_bucket", "capacity": "1", "refill_rate": "0.001"})
+	server := NewServer(limiter)
+	rules, _ := ParseAccessRules(strings.NewReader("deny mallory"))
+	server.SetAccessRules(rules)
+	handler := server.Handler()
+
+	request := func(user, org string) int {
+		req := httptest.NewRequest(http.MethodGet, "/limited", nil)
+		req.Header.Set("X-User", user)
+		req.Header.Set("X-Org", org)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	// the organisation neither gets keys a bucket of their own nor around the rules
+	for i, want := range []int{200, 429} {
+		if code := request("alice", []string{"acme", "umbrella"}[i]); code != want {
+			t.Fatalf("request %d: expected %d, got %d", i, want, code)
+		}
+	}
+	if code := request("mallory", "acme"); code != 403 {
+		t.Fatalf("expected mallory to be denied in any organisation, got %d", code)
+	}
+}
@@ -0,0 +1,383 @@
+package limiter
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultIdleTTL is the time after which an idle key is evicted
+	DefaultIdleTTL = 10 * time.Minute
+	// DefaultMaxKeys is the maximum number of keys tracked by a limiter
+	DefaultMaxKeys = 100000
+	// DefaultShards is the number of independently locked shards of a limiter
+	DefaultShards = 64
+)
+
+// KeyStoreConfig controls how a limiter stores its per-key state
+type KeyStoreConfig struct {
+	// IdleTTL is the time after which a key whose state is back to its
+	// initial (full/empty) state is evicted. 0 disables idle eviction.
+	IdleTTL time.Duration
+	// MaxKeys is the maximum number of keys tracked, across all the shards.
+	// Once reached, the least recently used key is evicted to make room.
+	// 0 means no limit.
+	MaxKeys int
+	// Shards is the number of shards the keys are spread over. Requests for
+	// keys in different shards never wait for each other.
+	Shards int
+}
+
+// Parse parses the args and populates the KeyStoreConfig, using the defaults
+// for missing values
+func (ksc *KeyStoreConfig) Parse(config RateConfig) error {
+	var err error
+
+	ksc.IdleTTL, ksc.MaxKeys, ksc.Shards = DefaultIdleTTL, DefaultMaxKeys, DefaultShards
+	if config["idle_ttl"] != "" {
+		ksc.IdleTTL, err = config.duration("idle_ttl")
+		if err != nil {
+			return err
+		}
+		if ksc.IdleTTL < 0 {
+			return fmt.Errorf("idle_ttl must not be negative, got %s", ksc.IdleTTL)
+		}
+	}
+	if config["max_keys"] != "" {
+		keys, err := config.int("max_keys")
+		if err != nil {
+			return err
+		}
+		if keys < 0 {
+			return fmt.Errorf("max_keys must not be negative, got %d", keys)
+		}
+		ksc.MaxKeys = int(keys)
+	}
+	if config["shards"] != "" {
+		shards, err := config.int("shards")
+		if err != nil {
+			return err
+		}
+		if shards <= 0 {
+			return fmt.Errorf("shards must be positive, got %d", shards)
+		}
+		ksc.Shards = int(shards)
+	}
+	return nil
+}
+
+// keyState is the per-key state of a limiter (a bucket, window, log, etc.)
+type keyState interface {
+	// idle reports if the state is back to its initial state as of now, i.e.
+	// forgetting it does not change any future decision
+	idle(now time.Time) bool
+	// stats returns the stats of the state as of now
+	stats(now time.Time) map[string]interface{}
+}
+
+// keyEntry is a key's state along with the time it was last used
+type keyEntry[T keyState] struct {
+	key      string
+	state    T
+	lastSeen time.Time
+}
+
+// keyShard holds the keys of a keyStore that hash to the same shard
+type keyShard[T keyState] struct {
+	mu sync.Mutex
+	// items is a map of key to its element in lru
+	items map[string]*list.Element
+	// lru holds *keyEntry values, the most recently used at the front
+	lru *list.List
+	// store is the store the shard is part of
+	store *keyStore[T]
+}
+
+// keyStore holds the per-key state of a limiter, spread over shards with a
+// lock each. It evicts keys that have been idle for longer than the
+// configured TTL (from a background janitor) and the least recently used key
+// once the store holds the maximum number of keys.
+type keyStore[T keyState] struct {
+	shards []*keyShard[T]
+	// count is the number of keys, of all the shards
+	count atomic.Int64
+	// newState creates the state for a key seen for the first time
+	newState func(key string) T
+	// onRemove, if set, is called with the state of every key removed or
+	// evicted, with the key's shard locked
+	onRemove func(state T)
+	config   KeyStoreConfig
+	clock    Clock
+	// stop is closed to stop the janitor
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newKeyStore creates a keyStore and starts its janitor
+func newKeyStore[T keyState](config KeyStoreConfig, clock Clock, newState func(key string) T) *keyStore[T] {
+	return newKeyStoreOnRemove(config, clock, newState, nil)
+}
+
+// newKeyStoreOnRemove is newKeyStore, calling onRemove with the state of every
+// key removed or evicted
+func newKeyStoreOnRemove[T keyState](config KeyStoreConfig, clock Clock, newState func(key string) T, onRemove func(T)) *keyStore[T] {
+	if config.Shards <= 0 {
+		config.Shards = 1
+	}
+	ks := &keyStore[T]{
+		shards:   make([]*keyShard[T], config.Shards),
+		newState: newState,
+		onRemove: onRemove,
+		config:   config,
+		clock:    clock,
+		stop:     make(chan struct{}),
+	}
+	for i := range ks.shards {
+		ks.shards[i] = &keyShard[T]{
+			items: make(map[string]*list.Element),
+			lru:   list.New(),
+			store: ks,
+		}
+	}
+	if config.IdleTTL > 0 {
+		go ks.janitor(config.IdleTTL / 2)
+	}
+	return ks
+}
+
+// shard returns the shard of the key, picked by its FNV-1a hash
+func (ks *keyStore[T]) shard(key string) *keyShard[T] {
+	if len(ks.shards) == 1 {
+		return ks.shards[0]
+	}
+	return ks.shards[keyHash(key)%uint32(len(ks.shards))]
+}
+
+// keyHash returns the FNV-1a hash of the key
+func keyHash(key string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return hash
+}
+
+// get returns the state for the key, creating it if required. now is the
+// time the key is used at.
+func (ks *keyStore[T]) get(key string, now time.Time) T {
+	shard := ks.shard(key)
+
+	shard.mu.Lock()
+	if elem := shard.items[key]; elem != nil {
+		entry := elem.Value.(*keyEntry[T])
+		entry.lastSeen = now
+		shard.lru.MoveToFront(elem)
+		shard.mu.Unlock()
+		return entry.state
+	}
+	entry := &keyEntry[T]{key: key, state: ks.newState(key), lastSeen: now}
+	shard.items[key] = shard.lru.PushFront(entry)
+	shard.mu.Unlock()
+
+	// the shard is unlocked first, as evicting locks the other shards
+	if max := int64(ks.config.MaxKeys); ks.count.Add(1) > max && max > 0 {
+		for ks.count.Load() > max && ks.evictOldest(key) {
+		}
+	}
+	return entry.state
+}
+
+// getIfRoom returns the state for the key, creating it only if the store
+// holds fewer than the maximum number of keys. Unlike get, it never evicts
+// a key, it returns false instead.
+func (ks *keyStore[T]) getIfRoom(key string, now time.Time) (T, bool) {
+	shard := ks.shard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if elem := shard.items[key]; elem != nil {
+		entry := elem.Value.(*keyEntry[T])
+		entry.lastSeen = now
+		shard.lru.MoveToFront(elem)
+		return entry.state, true
+	}
+	if max := int64(ks.config.MaxKeys); ks.count.Add(1) > max && max > 0 {
+		ks.count.Add(-1)
+		var zero T
+		return zero, false
+	}
+	entry := &keyEntry[T]{key: key, state: ks.newState(key), lastSeen: now}
+	shard.items[key] = shard.lru.PushFront(entry)
+	return entry.state, true
+}
+
+// evictOldest evicts the least recently used key of all the shards, other
+// than the key kept. It returns false if there is no other key.
+func (ks *keyStore[T]) evictOldest(kept string) bool {
+	// the shards are locked one at a time, the least recently used key of
+	// each one is at the back of its lru
+	var oldest *keyShard[T]
+	var oldestSeen time.Time
+	for _, shard := range ks.shards {
+		shard.mu.Lock()
+		if back := shard.lru.Back(); back != nil {
+			entry := back.Value.(*keyEntry[T])
+			if entry.key != kept && (oldest == nil || entry.lastSeen.Before(oldestSeen)) {
+				oldest, oldestSeen = shard, entry.lastSeen
+			}
+		}
+		shard.mu.Unlock()
+	}
+	if oldest == nil {
+		return false
+	}
+
+	oldest.mu.Lock()
+	defer oldest.mu.Unlock()
+	// the back may have changed meanwhile, evicting it is still fair enough
+	if back := oldest.lru.Back(); back != nil && back.Value.(*keyEntry[T]).key != kept {
+		oldest.removeElement(back)
+	}
+	return true
+}
+
+// lookup returns the state for the key, if the key is present, without
+// creating it or marking it as used
+func (ks *keyStore[T]) lookup(key string) (T, bool) {
+	shard := ks.shard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if elem := shard.items[key]; elem != nil {
+		return elem.Value.(*keyEntry[T]).state, true
+	}
+	var zero T
+	return zero, false
+}
+
+// remove removes the key and returns its state, if the key was present
+func (ks *keyStore[T]) remove(key string) (T, bool) {
+	shard := ks.shard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	elem := shard.items[key]
+	if elem == nil {
+		var zero T
+		return zero, false
+	}
+	return shard.removeElement(elem), true
+}
+
+// removeIdle removes the key if its state is idle as of now
+func (ks *keyStore[T]) removeIdle(key string, now time.Time) {
+	shard := ks.shard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if elem := shard.items[key]; elem != nil && elem.Value.(*keyEntry[T]).state.idle(now) {
+		shard.removeElement(elem)
+	}
+}
+
+// removeElement removes an element of lru, the lock must be held
+func (s *keyShard[T]) removeElement(elem *list.Element) T {
+	entry := s.lru.Remove(elem).(*keyEntry[T])
+	delete(s.items, entry.key)
+	s.store.count.Add(-1)
+	if s.store.onRemove != nil {
+		s.store.onRemove(entry.state)
+	}
+	return entry.state
+}
+
+// entries returns the entries of the shard
+func (s *keyShard[T]) entries() []*keyEntry[T] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]*keyEntry[T], 0, s.lru.Len())
+	for elem := s.lru.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, elem.Value.(*keyEntry[T]))
+	}
+	return entries
+}
+
+// each calls fn for every key and its state. Only one shard is locked at a
+// time (and not while fn runs), keys added or removed meanwhile may or may
+// not be visited.
+func (ks *keyStore[T]) each(fn func(key string, state T)) {
+	for _, shard := range ks.shards {
+		for _, entry := range shard.entries() {
+			fn(entry.key, entry.state)
+		}
+	}
+}
+
+// snapshot returns the stats of every key as of now
+func (ks *keyStore[T]) snapshot(now time.Time) map[string]interface{} {
+	data := make(map[string]interface{})
+	ks.each(func(key string, state T) {
+		data[key] = state.stats(now)
+	})
+	return data
+}
+
+// len returns the number of keys in the store
+func (ks *keyStore[T]) len() int { return int(ks.count.Load()) }
+
+// evictIdle removes the keys that have not been used since now - IdleTTL and
+// whose state is back to its initial state
+func (ks *keyStore[T]) evictIdle(now time.Time) {
+	cutoff := now.Add(-ks.config.IdleTTL)
+	for _, shard := range ks.shards {
+		shard.evictIdle(now, cutoff)
+	}
+}
+
+// evictIdle removes the idle keys of the shard not used since cutoff
+func (s *keyShard[T]) evictIdle(now, cutoff time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// walk from the least recently used key, stop at the first recent one
+	for elem := s.lru.Back(); elem != nil; {
+		entry := elem.Value.(*keyEntry[T])
+		if entry.lastSeen.After(cutoff) {
+			break
+		}
+		prev := elem.Prev()
+		if entry.state.idle(now) {
+			s.removeElement(elem)
+		}
+		elem = prev
+	}
+}
+
+// janitor periodically evicts idle keys until the store is closed. The
+// interval is measured in real time, idleness with the store's clock.
+func (ks *keyStore[T]) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ks.evictIdle(ks.clock.Now())
+		case <-ks.stop:
+			return
+		}
+	}
+}
+
+// close stops the janitor
+func (ks *keyStore[T]) close() {
+	ks.stopOnce.Do(func() { close(ks.stop) })
+}
@@ -0,0 +1,150 @@
+package limiter
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestKeyStoreMaxKeys(t *testing.T) {
+	limiter := NewRateLimiterFromConfig(RateConfig{
+		"algo":        "token_bucket",
+		"capacity":    "1",
+		"refill_rate": "0.001",
+		"max_keys":    "2",
+		"shards":      "1",
+	}).(*TBLimiter)
+	defer limiter.Stop()
+
+	for _, key := range []string{"a", "b", "a", "c"} {
+		_ = limiter.Allow(key)
+	}
+	// "b" is the least recently used key when "c" is added
+	if n := limiter.buckets.len(); n != 2 {
+		t.Fatalf("expected 2 keys, got %d", n)
+	}
+	if _, ok := limiter.buckets.remove("b"); ok {
+		t.Fatal("expected the least recently used key to be evicted")
+	}
+	if limiter.Allow("a") == nil {
+		t.Fatal("expected recently used keys to keep their state")
+	}
+}
+
+func TestKeyStoreEvictIdle(t *testing.T) {
+	configs := []RateConfig{
+		{"algo": "token_bucket", "capacity": "1", "refill_rate": "1"},
+		{"algo": "fixed_window_counter", "max_request_count": "1", "window_size": "1s"},
+		{"algo": "sliding_window_log", "request_per_sec": "1", "window_size": "1s"},
+		{"algo": "sliding_window_counter", "max_request_count": "1", "window_size": "1s"},
+		{"algo": "gcra", "capacity": "1", "refill_rate": "1"},
+		{"algo": "leaky_bucket", "capacity": "1", "leak_rate": "1"},
+		{"algo": "quota", "quota": "1", "quota_period": "minute"},
+	}
+	for _, config := range configs {
+		t.Run(config["algo"], func(t *testing.T) {
+			config["idle_ttl"] = "1m"
+			limiter := NewRateLimiterFromConfig(config)
+			defer limiter.Stop()
+
+			_ = limiter.Allow("user")
+			now := time.Now()
+			evictIdle := func(now time.Time) int {
+				switch l := limiter.(type) {
+				case *TBLimiter:
+					l.buckets.evictIdle(now)
+					return l.buckets.len()
+				case *WindowLimiterImpl:
+					l.windows.evictIdle(now)
+					return l.windows.len()
+				case *SlidingWindowLogRateLimiter:
+					l.logs.evictIdle(now)
+					return l.logs.len()
+				case *SlidingWindowCounterLimiter:
+					l.counters.evictIdle(now)
+					return l.counters.len()
+				case *GCRALimiter:
+					l.cells.evictIdle(now)
+					return l.cells.len()
+				case *QuotaLimiter:
+					l.quotas.evictIdle(now)
+					return l.quotas.len()
+				case *LeakyBucketLimiter:
+					l.buckets.evictIdle(now)
+					return l.buckets.len()
+				}
+				t.Fatalf("unexpected limiter %T", limiter)
+				return 0
+			}
+			if n := evictIdle(now); n != 1 {
+				t.Fatalf("expected a recently used key to be kept, got %d keys", n)
+			}
+			if n := evictIdle(now.Add(time.Hour)); n != 0 {
+				t.Fatalf("expected an idle key to be evicted, got %d keys", n)
+			}
+		})
+	}
+}
+
+func TestKeyStoreKeepsBusyKeys(t *testing.T) {
+	limiter := NewRateLimiterFromConfig(RateConfig{
+		"algo":        "token_bucket",
+		"capacity":    "1",
+		"refill_rate": "0.0001",
+		"idle_ttl":    "1m",
+	}).(*TBLimiter)
+	defer limiter.Stop()
+
+	_ = limiter.Allow("user")
+	// the bucket has not refilled after an hour, forgetting it would reset the limit
+	limiter.buckets.evictIdle(time.Now().Add(time.Hour))
+	if n := limiter.buckets.len(); n != 1 {
+		t.Fatalf("expected the bucket to be kept until it refills, got %d keys", n)
+	}
+}
+
+func TestKeyStoreShards(t *testing.T) {
+	limiter := NewRateLimiterFromConfig(RateConfig{
+		"algo":        "token_bucket",
+		"capacity":    "1",
+		"refill_rate": "0.001",
+		"max_keys":    "8",
+		"shards":      "4",
+	}).(*TBLimiter)
+	defer limiter.Stop()
+
+	for i := 0; i < 100; i++ {
+		_ = limiter.Allow(string(rune('a' + i%26)))
+	}
+	// the maximum is shared by the shards, and the least recently used keys
+	// of any shard are evicted
+	n := 0
+	for _, shard := range limiter.buckets.shards {
+		n += shard.lru.Len()
+	}
+	if n != 8 || limiter.buckets.len() != 8 {
+		t.Fatalf("expected 8 keys, got %d", n)
+	}
+	for i := 92; i < 100; i++ {
+		if _, ok := limiter.buckets.remove(string(rune('a' + i%26))); !ok {
+			t.Fatalf("expected the most recently used key %q to be kept", string(rune('a'+i%26)))
+		}
+	}
+}
+
+func TestKeyStoreMaxKeysBelowShards(t *testing.T) {
+	limiter := NewRateLimiterFromConfig(RateConfig{
+		"algo":        "token_bucket",
+		"capacity":    "1",
+		"refill_rate": "0.001",
+		"max_keys":    "10",
+	}).(*TBLimiter)
+	defer limiter.Stop()
+
+	for i := 0; i < 1000; i++ {
+		_ = limiter.Allow(strconv.Itoa(i))
+	}
+	if n := limiter.buckets.len(); n != 10 {
+		t.Fatalf("expected max_keys to cap the keys of the %d shards, got %d keys", DefaultShards, n)
+	}
+}
@@ -0,0 +1,322 @@
+package limiter
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBanned = fmt.Errorf("key is temporarily banned")
+)
+
+// PenaltyBox wraps a RateLimiter and bans the keys that keep being rejected
+// (fail2ban-style). Once a key is rejected Threshold times within Window, it
+// is banned: its requests are rejected without being evaluated by the
+// wrapped limiter until the ban ends. Every ban of a key lasts Multiplier
+// times longer than the previous one, up to MaxBanDuration. A key that goes
+// MaxBanDuration after its last ban without being banned again starts over.
+type PenaltyBox struct {
+	limiter RateLimiter
+	config  *PenaltyConfig
+	clock   Clock
+
+	mu sync.Mutex
+	// offenders maps a key to its rejections and bans
+	offenders map[string]*offender
+	// swept is the number of offenders after the last sweep
+	swept int
+}
+
+// NewPenaltyBox wraps the limiter in a PenaltyBox
+func NewPenaltyBox(limiter RateLimiter, config *PenaltyConfig, opts ...Option) *PenaltyBox {
+	o := &options{clock: RealClock()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return &PenaltyBox{
+		limiter:   limiter,
+		config:    config,
+		clock:     o.clock,
+		offenders: make(map[string]*offender),
+	}
+}
+
+// Ban is a key banned until a given time
+type Ban struct {
+	Key   string    `json:"key"`
+	Until time.Time `json:"until"`
+	// Count is the number of times the key was banned in a row
+	Count int `json:"count"`
+}
+
+// offender holds the recent rejections and the bans of a key
+type offender struct {
+	// rejections are the times of the rejections since the last ban, within
+	// the window
+	rejections []time.Time
+	// bans is the number of bans in a row
+	bans        int
+	bannedUntil time.Time
+}
+
+// Allow checks if a request can be allowed
+func (p *PenaltyBox) Allow(key string) error {
+	return p.AllowN(key, 1)
+}
+
+// AllowN checks if a request costing n tokens can be allowed. Requests of a
+// banned key are rejected with ErrBanned.
+func (p *PenaltyBox) AllowN(key string, n int) error {
+	if n < 0 {
+		return ErrInvalidCost
+	}
+	if _, banned := p.banned(key); banned {
+		return ErrBanned
+	}
+	err := p.limiter.AllowN(key, n)
+	if err != nil {
+		p.reject(key)
+	}
+	return err
+}
+
+// Decide checks if a request can be allowed. The decision of a banned key has
+// the time left in the ban as its RetryAfter.
+func (p *PenaltyBox) Decide(key string) Decision {
+	return p.decide(key, func() Decision { return p.limiter.Decide(key) })
+}
+
+// DecidePriority checks if a request of the priority class can be allowed. The
+// priority is ignored if the wrapped limiter does not take it into account.
+func (p *PenaltyBox) DecidePriority(key string, priority Priority) Decision {
+	return p.decide(key, func() Decision {
+		if l, ok := p.limiter.(PriorityAware); ok {
+			return l.DecidePriority(key, priority)
+		}
+		return p.limiter.Decide(key)
+	})
+}
+
+// decide rejects the request of a banned key, or decides with the wrapped
+// limiter and counts the rejection
+func (p *PenaltyBox) decide(key string, decide func() Decision) Decision {
+	if until, banned := p.banned(key); banned {
+		now := p.clock.Now()
+		return Decision{
+			Limit:      p.limiter.GetLimit(),
+			ResetAt:    until,
+			RetryAfter: until.Sub(now),
+		}
+	}
+	d := decide()
+	if !d.Allowed {
+		if until, banned := p.reject(key); banned && until.Sub(p.clock.Now()) > d.RetryAfter {
+			d.ResetAt, d.RetryAfter = until, until.Sub(p.clock.Now())
+		}
+	}
+	return d
+}
+
+// Done releases the in flight slot of the key, if the wrapped limiter limits
+// requests in flight
+func (p *PenaltyBox) Done(key string) {
+	p.DoneN(key, 1)
+}
+
+// DoneN releases n in flight slots of the key, if the wrapped limiter limits
+// requests in flight
+func (p *PenaltyBox) DoneN(key string, n int) {
+	if l, ok := p.limiter.(InFlightLimiter); ok {
+		l.DoneN(key, n)
+	}
+}
+
+// banned returns the end of the key's ban, if it is banned
+func (p *PenaltyBox) banned(key string) (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	o := p.offenders[key]
+	if o == nil || !p.clock.Now().Before(o.bannedUntil) {
+		return time.Time{}, false
+	}
+	return o.bannedUntil, true
+}
+
+// reject counts a rejection of the key, banning it once it reaches the
+// threshold. It returns the end of the ban if the key got banned.
+func (p *PenaltyBox) reject(key string) (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock.Now()
+	o := p.offenders[key]
+	if o == nil {
+		// sweep whenever the offenders doubled, forgetting the keys that
+		// behave again
+		if len(p.offenders) >= 2*p.swept {
+			p.sweep(now)
+		}
+		o = &offender{}
+		p.offenders[key] = o
+	}
+	if o.bans > 0 && !now.Before(o.bannedUntil.Add(p.config.MaxBanDuration)) {
+		o.bans = 0
+	}
+
+	o.rejections = append(o.rejections, now)
+	for len(o.rejections) > 0 && !now.Before(o.rejections[0].Add(p.config.Window)) {
+		o.rejections = o.rejections[1:]
+	}
+	if len(o.rejections) < p.config.Threshold {
+		return time.Time{}, false
+	}
+
+	o.rejections = nil
+	o.bans++
+	o.bannedUntil = now.Add(p.config.banDuration(o.bans))
+	return o.bannedUntil, true
+}
+
+// sweep forgets the keys that are neither banned, nor were recently rejected
+// or banned. The lock must be held.
+func (p *PenaltyBox) sweep(now time.Time) {
+	for key, o := range p.offenders {
+		recent := len(o.rejections) > 0 && now.Before(o.rejections[len(o.rejections)-1].Add(p.config.Window))
+		if !recent && !now.Before(o.bannedUntil.Add(p.config.MaxBanDuration)) {
+			delete(p.offenders, key)
+		}
+	}
+	p.swept = len(p.offenders)
+}
+
+// Bans returns the keys banned right now, the earliest ban to end first
+func (p *PenaltyBox) Bans() []Ban {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock.Now()
+	bans := make([]Ban, 0)
+	for key, o := range p.offenders {
+		if now.Before(o.bannedUntil) {
+			bans = append(bans, Ban{Key: key, Until: o.bannedUntil, Count: o.bans})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		if !bans[i].Until.Equal(bans[j].Until) {
+			return bans[i].Until.Before(bans[j].Until)
+		}
+		return bans[i].Key < bans[j].Key
+	})
+	return bans
+}
+
+// Unban lifts the ban of the key and forgets its rejections. It reports if
+// the key was banned.
+func (p *PenaltyBox) Unban(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	o := p.offenders[key]
+	if o == nil {
+		return false
+	}
+	delete(p.offenders, key)
+	return p.clock.Now().Before(o.bannedUntil)
+}
+
+// Unwrap returns the wrapped limiter
+func (p *PenaltyBox) Unwrap() RateLimiter { return p.limiter }
+
+// Unregister removes the key's state in the wrapped limiter. Its bans are
+// kept, they are lifted with Unban.
+func (p *PenaltyBox) Unregister(key string) { p.limiter.Unregister(key) }
+
+// Stop stops the wrapped limiter
+func (p *PenaltyBox) Stop() { p.limiter.Stop() }
+
+// Stats returns the stats of the wrapped limiter and the keys banned right now
+func (p *PenaltyBox) Stats() interface{} {
+	return map[string]interface{}{
+		"limiter": p.limiter.Stats(),
+		"bans":    p.Bans(),
+	}
+}
+
+func (p *PenaltyBox) GetLimit() int { return p.limiter.GetLimit() }
+
+// PenaltyConfig is the configuration for the penalty box
+type PenaltyConfig struct {
+	// Threshold is the number of rejections within Window that get a key
+	// banned. 0 disables the penalty box.
+	Threshold int
+	Window    time.Duration
+	// BanDuration is the duration of the first ban of a key
+	BanDuration time.Duration
+	// Multiplier is the factor every following ban is longer by
+	Multiplier float64
+	// MaxBanDuration caps the duration of the bans
+	MaxBanDuration time.Duration
+}
+
+// Parse parses the args and populates the PenaltyConfig
+func (pc *PenaltyConfig) Parse(config RateConfig) error {
+	pc.Threshold, pc.Multiplier = 0, 2
+	pc.Window, pc.BanDuration, pc.MaxBanDuration = time.Minute, time.Minute, 24*time.Hour
+
+	var err error
+	if config["ban_threshold"] != "" {
+		if pc.Threshold, err = config.int("ban_threshold"); err != nil {
+			return err
+		}
+	}
+	if pc.Threshold < 0 {
+		return fmt.Errorf("ban_threshold must not be negative, got %d", pc.Threshold)
+	}
+	if config["ban_multiplier"] != "" {
+		if pc.Multiplier, err = config.float("ban_multiplier"); err != nil {
+			return err
+		}
+	}
+	if pc.Multiplier < 1 {
+		return fmt.Errorf("ban_multiplier must be at least 1, got %v", pc.Multiplier)
+	}
+	for key, value := range map[string]*time.Duration{
+		"ban_window":       &pc.Window,
+		"ban_duration":     &pc.BanDuration,
+		"max_ban_duration": &pc.MaxBanDuration,
+	} {
+		if config[key] == "" {
+			continue
+		}
+		if *value, err = config.duration(key); err != nil {
+			return err
+		}
+		if *value <= 0 {
+			return fmt.Errorf("%s must be positive, got %s", key, *value)
+		}
+	}
+	if pc.MaxBanDuration < pc.BanDuration {
+		return fmt.Errorf("max_ban_duration must not be shorter than ban_duration, got %s < %s",
+			pc.MaxBanDuration, pc.BanDuration)
+	}
+	return nil
+}
+
+// banDuration returns the duration of the nth ban in a row of a key
+func (pc *PenaltyConfig) banDuration(n int) time.Duration {
+	d := float64(pc.BanDuration) * math.Pow(pc.Multiplier, float64(n-1))
+	if d >= float64(pc.MaxBanDuration) {
+		return pc.MaxBanDuration
+	}
+	return time.Duration(d)
+}
+
+// check that the penalty box passes priorities and in flight slots through
+var (
+	_ PriorityAware   = &PenaltyBox{}
+	_ InFlightLimiter = &PenaltyBox{}
+)
@@ -0,0 +1,98 @@
+package limiter
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var penaltyConfig = RateConfig{
+	"algo": "token_bucket", "capacity": "1", "refill_rate": "0.001",
+	"ban_threshold": "2", "ban_window": "1m", "ban_duration": "10s", "max_ban_duration": "30s",
+}
+
+func TestPenaltyBoxEscalates(t *testing.T) {
+	rl, clock := newFakeClockLimiter(penaltyConfig)
+	defer rl.Stop()
+	limiter := rl.(*PenaltyBox)
+
+	if err := limiter.Allow("alice"); err != nil {
+		t.Fatalf("expected the first request to be allowed, got %v", err)
+	}
+	// every ban lasts twice as long as the previous one, up to 30s
+	for i, want := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second} {
+		for j := 0; j < 2; j++ {
+			if err := limiter.Allow("alice"); err == nil || errors.Is(err, ErrBanned) {
+				t.Fatalf("ban %d: expected the limiter to reject request %d, got %v", i, j, err)
+			}
+		}
+		if err := limiter.Allow("alice"); !errors.Is(err, ErrBanned) {
+			t.Fatalf("ban %d: expected ErrBanned, got %v", i, err)
+		}
+		bans := limiter.Bans()
+		if len(bans) != 1 || bans[0].Count != i+1 || !bans[0].Until.Equal(clock.Now().Add(want)) {
+			t.Fatalf("ban %d: expected alice to be banned for %s, got %+v", i, want, bans)
+		}
+		if d := limiter.Decide("alice"); d.Allowed || d.RetryAfter != want {
+			t.Fatalf("ban %d: expected to retry after %s, got %+v", i, want, d)
+		}
+		clock.Advance(want)
+	}
+
+	// a key banned again long after its last ban starts over
+	clock.Advance(30 * time.Second)
+	limiter.Allow("alice")
+	limiter.Allow("alice")
+	if bans := limiter.Bans(); len(bans) != 1 || bans[0].Count != 1 {
+		t.Fatalf("expected the bans to start over, got %+v", bans)
+	}
+
+	if !limiter.Unban("alice") {
+		t.Fatal("expected alice to be unbanned")
+	}
+	if err := limiter.Allow("alice"); errors.Is(err, ErrBanned) {
+		t.Fatalf("expected alice's requests to be evaluated again, got %v", err)
+	}
+}
+
+func TestServerBans(t *testing.T) {
+	limiter, _ := newFakeClockLimiter(penaltyConfig)
+	server := NewServer(limiter)
+	handler, admin := server.Handler(), server.AdminHandler()
+
+	request := func(handler http.Handler, method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-User", "alice")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for i := 0; i < 3; i++ {
+		request(handler, http.MethodGet, "/limited")
+	}
+	if bans := limiter.(*PenaltyBox).Bans(); len(bans) != 1 || bans[0].Key != "alice" {
+		t.Fatalf("expected alice to be banned, got %+v", bans)
+	}
+	// a banned client can not lift its own ban
+	if code := request(handler, http.MethodDelete, "/bans/alice"); code != 404 {
+		t.Fatalf("expected the rate limited routes not to lift bans, got %d", code)
+	}
+	if code := request(admin, http.MethodGet, "/bans"); code != 200 {
+		t.Fatalf("expected the bans to be listed, got %d", code)
+	}
+	if code := request(admin, http.MethodDelete, "/bans/alice"); code != 200 {
+		t.Fatalf("expected alice to be unbanned, got %d", code)
+	}
+	if code := request(admin, http.MethodDelete, "/bans/alice"); code != 404 {
+		t.Fatalf("expected 404 for a key not banned, got %d", code)
+	}
+
+	other := NewServer(NewRateLimiterFromConfig(RateConfig{})).AdminHandler()
+	rec := httptest.NewRecorder()
+	other.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/bans", nil))
+	if rec.Code != 404 {
+		t.Fatalf("expected 404 without a penalty box, got %d", rec.Code)
+	}
+}
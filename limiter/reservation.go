@@ -0,0 +1,108 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCannotReserve       = fmt.Errorf("request exceeds the limit and can never be allowed")
+	ErrWouldExceedDeadline = fmt.Errorf("waiting for the request would exceed the context deadline")
+)
+
+// BlockingRateLimiter is a RateLimiter that can also hand out capacity ahead
+// of time, so callers can slow down instead of being rejected.
+type BlockingRateLimiter interface {
+	RateLimiter
+	// Reserve reserves capacity for one request
+	Reserve(string) *Reservation
+	// ReserveN reserves capacity for a request counting as n requests
+	ReserveN(string, int) *Reservation
+	// Wait blocks until one request is allowed or the context is done
+	Wait(context.Context, string) error
+	// WaitN blocks until a request counting as n requests is allowed or the
+	// context is done
+	WaitN(context.Context, string, int) error
+}
+
+// Reservation is capacity taken from a limiter for a request that may
+// proceed once its delay has passed.
+type Reservation struct {
+	// ok is false if the request can never be allowed
+	ok bool
+	// timeToAct is the time at which the request may proceed
+	timeToAct time.Time
+	// clock is the clock of the limiter that made the reservation
+	clock Clock
+	// cancel returns the reserved capacity to the limiter
+	cancel func(now time.Time)
+	once   sync.Once
+	// decision is the state of the limiter right after the reservation
+	decision Decision
+}
+
+// OK returns false if the limiter can never allow the request, in which case
+// nothing was reserved
+func (r *Reservation) OK() bool { return r.ok }
+
+// Delay returns the time to wait before the reserved request may proceed
+func (r *Reservation) Delay() time.Duration {
+	if !r.ok {
+		return maxWait
+	}
+	return r.DelayFrom(r.clock.Now())
+}
+
+// DelayFrom returns the time to wait from now before the reserved request may
+// proceed. It returns maxWait if the reservation is not OK.
+func (r *Reservation) DelayFrom(now time.Time) time.Duration {
+	if !r.ok {
+		return maxWait
+	}
+	if delay := r.timeToAct.Sub(now); delay > 0 {
+		return delay
+	}
+	return 0
+}
+
+// Cancel returns the reserved capacity to the limiter, for requests that
+// will not be made after all. Calling Cancel more than once has no effect.
+func (r *Reservation) Cancel() {
+	if !r.ok || r.cancel == nil {
+		return
+	}
+	r.once.Do(func() { r.cancel(r.clock.Now()) })
+}
+
+// wait blocks until the reservation's delay has passed. The reservation is
+// cancelled if the context is done (or would be) before then.
+func wait(ctx context.Context, r *Reservation) error {
+	if !r.OK() {
+		return ErrCannotReserve
+	}
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+	// the context deadline is in real time, compare the durations left
+	if dl, ok := ctx.Deadline(); ok && time.Until(dl) < delay {
+		r.Cancel()
+		return ErrWouldExceedDeadline
+	}
+	select {
+	case <-r.clock.After(delay):
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
+}
+
+// check that the limiters support reservations
+var _ BlockingRateLimiter = &TBLimiter{}
+var _ BlockingRateLimiter = &WindowLimiterImpl{}
+var _ BlockingRateLimiter = &SlidingWindowLogRateLimiter{}
+var _ BlockingRateLimiter = &CompositeLimiter{}
+var _ BlockingRateLimiter = &QuotaLimiter{}
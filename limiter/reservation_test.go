@@ -0,0 +1,103 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// blockingConfigs have room for 2 requests, which frees up again after 25ms to 1s
+var blockingConfigs = []RateConfig{
+	{"algo": "token_bucket", "capacity": "2", "refill_rate": "40"},
+	{"algo": "fixed_window_counter", "max_request_count": "2", "window_size": "50ms"},
+	{"algo": "sliding_window_log", "request_per_sec": "2", "window_size": "1s"},
+	{"algo": "composite", "limits": "token_bucket:capacity=2,refill_rate=40;fixed_window_counter:max_request_count=5,window_size=1s"},
+}
+
+func TestReserve(t *testing.T) {
+	for _, config := range blockingConfigs {
+		t.Run(config["algo"], func(t *testing.T) {
+			limiter := NewRateLimiterFromConfig(config).(BlockingRateLimiter)
+			for i := 0; i < 2; i++ {
+				if r := limiter.Reserve("user"); !r.OK() || r.Delay() != 0 {
+					t.Fatalf("request %d: expected an immediate reservation, got delay %s", i, r.Delay())
+				}
+			}
+			r := limiter.Reserve("user")
+			if !r.OK() || r.Delay() <= 0 {
+				t.Fatalf("expected a delayed reservation, got delay %s", r.Delay())
+			}
+			if limiter.Allow("user") == nil {
+				t.Fatal("expected the reserved capacity to be unavailable")
+			}
+			if r := limiter.ReserveN("user", 3); r.OK() {
+				t.Fatal("expected a reservation above the limit to fail")
+			}
+			// cancelling returns the capacity, the next reservation gets the same delay
+			delay := r.Delay()
+			r.Cancel()
+			r.Cancel()
+			if next := limiter.Reserve("user"); !next.OK() || next.Delay() > delay {
+				t.Fatalf("expected cancelled capacity to be reused, got delay %s > %s", next.Delay(), delay)
+			}
+		})
+	}
+}
+
+func TestWait(t *testing.T) {
+	for _, config := range blockingConfigs {
+		t.Run(config["algo"], func(t *testing.T) {
+			limiter, clock := newFakeClockLimiter(config)
+			blocking := limiter.(BlockingRateLimiter)
+			if err := blocking.AllowN("user", 2); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			defer cancel()
+			if err := blocking.Wait(ctx, "user"); err != ErrWouldExceedDeadline {
+				t.Fatalf("expected ErrWouldExceedDeadline, got %v", err)
+			}
+			if err := blocking.WaitN(context.Background(), "user", 3); err != ErrCannotReserve {
+				t.Fatalf("expected ErrCannotReserve, got %v", err)
+			}
+
+			done := make(chan error)
+			go func() { done <- blocking.Wait(context.Background(), "user") }()
+			for clock.Waiters() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			select {
+			case err := <-done:
+				t.Fatalf("expected Wait to block, returned %v", err)
+			default:
+			}
+			clock.Advance(time.Second)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWaitCancelled(t *testing.T) {
+	limiter, clock := newFakeClockLimiter(RateConfig{"algo": "token_bucket", "capacity": "1", "refill_rate": "1"})
+	blocking := limiter.(BlockingRateLimiter)
+	_ = blocking.Allow("user")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- blocking.Wait(ctx, "user") }()
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	// the cancelled wait returned its token
+	clock.Advance(time.Second)
+	if err := blocking.Allow("user"); err != nil {
+		t.Fatalf("expected the refilled token to be available, got %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+package limiter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vamsaty/cc-rate-limiter/keys"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SelectFirst selects the first rule matching a request
+	SelectFirst = "first"
+	// SelectSpecific selects the most specific rule matching a request, the
+	// first one of those as specific
+	SelectSpecific = "specific"
+)
+
+// RulesConfig is the configuration of a RuleEngine
+type RulesConfig struct {
+	// Selection is SelectFirst (the default) or SelectSpecific
+	Selection string       `json:"selection"`
+	Rules     []RuleConfig `json:"rules"`
+}
+
+// RuleConfig is the configuration of a rule: the requests it matches, and
+// the limiter and key they are rate limited with
+type RuleConfig struct {
+	Name string `json:"name"`
+	// Methods are the methods matched, all of them if empty
+	Methods []string `json:"methods"`
+	// Path is the pattern of the paths matched, all of them if empty. A
+	// segment "{name}" matches any segment, and a last segment "*" matches
+	// the rest of the path, of one segment or more, e.g. "/users/{id}/*".
+	Path string `json:"path"`
+	// Host is the host matched, any if empty. "*.example.com" matches the
+	// subdomains of example.com.
+	Host string `json:"host"`
+	// Headers are the headers the requests must have, with the given value,
+	// or any value if empty
+	Headers map[string]string `json:"headers"`
+	// Limiter is the configuration of the limiter, as for NewRateLimiterFromConfig
+	Limiter RateConfig `json:"limiter"`
+	// Key is the spec of the key extractor (see keys.Parse). The key of the
+	// engine is used if empty.
+	Key string `json:"key"`
+}
+
+// LoadRulesConfig loads the rules configuration from the JSON file at path
+func LoadRulesConfig(path string) (*RulesConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &RulesConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// UnmarshalJSON reads the args from a JSON object, whose values may be
+// strings, numbers or booleans
+func (c *RateConfig) UnmarshalJSON(data []byte) error {
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	*c = make(RateConfig, len(values))
+	for key, value := range values {
+		switch v := value.(type) {
+		case string:
+			(*c)[key] = v
+		case float64:
+			(*c)[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			(*c)[key] = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("%s: expected a string, number or boolean, got %v", key, value)
+		}
+	}
+	return nil
+}
+
+// Rule is a rule of a RuleEngine
+type Rule struct {
+	Name    string
+	Limiter RateLimiter
+	Key     keys.Func
+
+	methods  map[string]bool
+	segments []string
+	host     string
+	headers  map[string]string
+}
+
+// RuleEngine selects the limiter and key a request is rate limited with, by
+// the first or most specific rule matching its method, path, host and headers
+type RuleEngine struct {
+	rules     []*Rule
+	selection string
+}
+
+// NewRuleEngine creates the limiters of the rules. The rules without a key
+// use the key given.
+func NewRuleEngine(config *RulesConfig, key keys.Func, keysConfig keys.Config, opts ...Option) (*RuleEngine, error) {
+	e := &RuleEngine{selection: config.Selection}
+	switch e.selection {
+	case "":
+		e.selection = SelectFirst
+	case SelectFirst, SelectSpecific:
+	default:
+		return nil, fmt.Errorf("selection must be %q or %q, got %q", SelectFirst, SelectSpecific, e.selection)
+	}
+
+	for i, rc := range config.Rules {
+		if rc.Name == "" {
+			rc.Name = fmt.Sprintf("rule %d", i)
+		}
+		rule, err := newRule(rc, key, keysConfig, opts)
+		if err != nil {
+			e.Stop()
+			return nil, fmt.Errorf("%s: %w", rc.Name, err)
+		}
+		e.rules = append(e.rules, rule)
+	}
+	return e, nil
+}
+
+// newRule creates the rule and its limiter
+func newRule(rc RuleConfig, key keys.Func, keysConfig keys.Config, opts []Option) (*Rule, error) {
+	var err error
+	rule := &Rule{
+		Name:     rc.Name,
+		Key:      key,
+		methods:  make(map[string]bool),
+		segments: splitPath(rc.Path),
+		host:     strings.ToLower(rc.Host),
+		headers:  rc.Headers,
+	}
+	for _, method := range rc.Methods {
+		rule.methods[strings.ToUpper(method)] = true
+	}
+	for i, segment := range rule.segments {
+		if segment == "*" && i != len(rule.segments)-1 {
+			return nil, fmt.Errorf("path %q: * must be the last segment", rc.Path)
+		}
+	}
+	if rc.Key != "" {
+		if rule.Key, err = keys.Parse(rc.Key, keysConfig); err != nil {
+			return nil, err
+		}
+	}
+	if rule.Key == nil {
+		return nil, fmt.Errorf("the rule has no key, and the engine none either")
+	}
+
+	if rule.Limiter, err = NewRateLimiter(rc.Limiter, opts...); err != nil {
+		return nil, fmt.Errorf("limiter: %w", err)
+	}
+	return rule, nil
+}
+
+// splitPath splits the path into its segments
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// Match returns the rule the request is rate limited by, or nil if none
+// matches it
+func (e *RuleEngine) Match(r *http.Request) *Rule {
+	if e == nil {
+		return nil
+	}
+	var match *Rule
+	var matchSpecificity [4]int
+	for _, rule := range e.rules {
+		if !rule.matches(r) {
+			continue
+		}
+		if e.selection == SelectFirst {
+			return rule
+		}
+		if s := rule.specificity(); match == nil || moreSpecific(s, matchSpecificity) {
+			match, matchSpecificity = rule, s
+		}
+	}
+	return match
+}
+
+// matches reports if the rule matches the request
+func (rule *Rule) matches(r *http.Request) bool {
+	if len(rule.methods) > 0 && !rule.methods[r.Method] {
+		return false
+	}
+	if rule.host != "" && !matchHost(rule.host, r.Host) {
+		return false
+	}
+	for name, value := range rule.headers {
+		if got := r.Header.Get(name); got == "" || (value != "" && got != value) {
+			return false
+		}
+	}
+
+	path := splitPath(r.URL.Path)
+	for i, segment := range rule.segments {
+		// the wildcard matches one segment or more, "/users/*" not "/users"
+		if segment == "*" {
+			return i < len(path)
+		}
+		if i >= len(path) {
+			return false
+		}
+		isParam := strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+		if !isParam && segment != path[i] {
+			return false
+		}
+	}
+	return len(path) == len(rule.segments)
+}
+
+// matchHost reports if the host, with or without a port, matches the pattern
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// specificity ranks how specific the rule is: by the literal segments of its
+// path, then the parameter segments, then without a trailing wildcard, then
+// by the number of its method, host and header conditions
+func (rule *Rule) specificity() [4]int {
+	var s [4]int
+	s[2] = 1
+	for _, segment := range rule.segments {
+		switch {
+		case segment == "*":
+			s[2] = 0
+		case strings.HasPrefix(segment, "{"):
+			s[1]++
+		default:
+			s[0]++
+		}
+	}
+	if len(rule.methods) > 0 {
+		s[3]++
+	}
+	if rule.host != "" {
+		s[3]++
+	}
+	s[3] += len(rule.headers)
+	return s
+}
+
+// moreSpecific reports if the specificity a is higher than b
+func moreSpecific(a, b [4]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
+
+// Rules returns the rules, in order
+func (e *RuleEngine) Rules() []*Rule { return e.rules }
+
+// Stop stops the limiters of the rules
+func (e *RuleEngine) Stop() {
+	for _, rule := range e.rules {
+		rule.Limiter.Stop()
+	}
+}
+
+// Stats returns the stats of the limiters, by the name of their rule
+func (e *RuleEngine) Stats() map[string]interface{} {
+	if e == nil {
+		return map[string]interface{}{}
+	}
+	stats := make(map[string]interface{}, len(e.rules))
+	for _, rule := range e.rules {
+		stats[rule.Name] = rule.Limiter.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,167 @@
+package limiter
+
+import (
+	"github.com/vamsaty/cc-rate-limiter/keys"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const rulesConfig = `{
+	"selection": "specific",
+	"rules": [
+		{"name": "api", "path": "/api/*", "limiter": {"algo": "token_bucket", "capacity": 100, "refill_rate": 100}},
+		{"name": "login", "methods": ["POST"], "path": "/login", "key": "ip",
+			"limiter": {"algo": "token_bucket", "capacity": 5, "refill_rate": 5}},
+		{"name": "items", "methods": ["get"], "path": "/items", "limiter": {"algo": "token_bucket", "capacity": 100, "refill_rate": 100}},
+		{"name": "user", "path": "/api/users/{id}", "limiter": {"algo": "token_bucket", "capacity": 10, "refill_rate": 1}},
+		{"name": "admin", "host": "*.admin.example.com", "path": "/api/*", "limiter": {"algo": "token_bucket", "capacity": 1, "refill_rate": 1}},
+		{"name": "beta", "headers": {"X-Beta": ""}, "path": "/api/*", "limiter": {"algo": "token_bucket", "capacity": 1, "refill_rate": 1}}
+	]
+}`
+
+// loadRules writes the rules configuration to a file and loads it
+func loadRules(t *testing.T, data string) *RulesConfig {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadRulesConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestRuleEngineMatch(t *testing.T) {
+	config := loadRules(t, rulesConfig)
+	if got := config.Rules[1].Limiter["capacity"]; got != "5" {
+		t.Fatalf("expected numbers to be read as strings, got %q", got)
+	}
+	engine, err := NewRuleEngine(config, keys.Header("X-User"), keys.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Stop()
+
+	for _, tc := range []struct {
+		method, target string
+		headers        map[string]string
+		want           string
+	}{
+		{http.MethodPost, "/login", nil, "login"},
+		{http.MethodGet, "/login", nil, ""},
+		{http.MethodGet, "/items", nil, "items"},
+		{http.MethodGet, "/items/42", nil, ""},
+		{http.MethodGet, "/api/orders", nil, "api"},
+		{http.MethodGet, "/api", nil, ""},
+		{http.MethodGet, "/api/users/42", nil, "user"},
+		{http.MethodGet, "/api/users/42/posts", nil, "api"},
+		{http.MethodGet, "http://eu.admin.example.com:8080/api/orders", nil, "admin"},
+		{http.MethodGet, "http://admin.example.com/api/orders", nil, "api"},
+		{http.MethodGet, "/api/orders", map[string]string{"X-Beta": "1"}, "beta"},
+		// the path is more specific than the header
+		{http.MethodGet, "/api/users/42", map[string]string{"X-Beta": "1"}, "user"},
+	} {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		for name, value := range tc.headers {
+			r.Header.Set(name, value)
+		}
+		got := ""
+		if rule := engine.Match(r); rule != nil {
+			got = rule.Name
+		}
+		if got != tc.want {
+			t.Errorf("%s %s %v: expected rule %q, got %q", tc.method, tc.target, tc.headers, tc.want, got)
+		}
+	}
+
+	// the first rule matching wins by default
+	config.Selection = ""
+	first, err := NewRuleEngine(config, keys.Header("X-User"), keys.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Stop()
+	if rule := first.Match(httptest.NewRequest(http.MethodGet, "/api/users/42", nil)); rule == nil || rule.Name != "api" {
+		t.Fatalf("expected the first rule to match, got %+v", rule)
+	}
+
+	for name, invalid := range map[string]RulesConfig{
+		"selection": {Selection: "best"},
+		"wildcard":  {Rules: []RuleConfig{{Path: "/api/*/users", Limiter: RateConfig{"algo": "token_bucket"}}}},
+		"key":       {Rules: []RuleConfig{{Key: "cookie:session", Limiter: RateConfig{"algo": "token_bucket"}}}},
+		"limiter":   {Rules: []RuleConfig{{Limiter: RateConfig{"algo": "token_bucket", "capacity": "many"}}}},
+		"algo":      {Rules: []RuleConfig{{Limiter: RateConfig{"algo": "tokenbucket"}}}},
+	} {
+		invalid := invalid
+		if _, err := NewRuleEngine(&invalid, keys.Header("X-User"), keys.Config{}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestServerRules(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	engine, err := NewRuleEngine(loadRules(t, rulesConfig), keys.Header("X-User"), keys.Config{}, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Stop()
+	limiter, _ := newFakeClockLimiter(RateConfig{"algo": "token_bucket", "capacity": "1", "refill_rate": "0.001"})
+	defer limiter.Stop()
+	server := NewServer(limiter, WithClock(clock))
+	server.SetRules(engine)
+	handler := server.Handler()
+
+	request := func(method, target string) int {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("X-User", "alice")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// 5 logins per second by IP address, 100 item listings per second by user
+	for i := 0; i < 5; i++ {
+		if code := request(http.MethodPost, "/login"); code != 200 {
+			t.Fatalf("login %d: expected 200, got %d", i, code)
+		}
+	}
+	if code := request(http.MethodPost, "/login"); code != 429 {
+		t.Fatalf("expected the 6th login to be rate limited, got %d", code)
+	}
+	for i := 0; i < 100; i++ {
+		if code := request(http.MethodGet, "/items"); code != 200 {
+			t.Fatalf("listing %d: expected 200, got %d", i, code)
+		}
+	}
+	if code := request(http.MethodGet, "/items"); code != 429 {
+		t.Fatalf("expected the 101st listing to be rate limited, got %d", code)
+	}
+
+	if code := request(http.MethodGet, "/unknown"); code != 404 {
+		t.Fatalf("expected routes without a rule to be unknown, got %d", code)
+	}
+	// /limited falls back to the server's limiter
+	if code := request(http.MethodGet, "/limited"); code != 200 {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := request(http.MethodGet, "/limited"); code != 429 {
+		t.Fatalf("expected the server's limiter to rate limit /limited, got %d", code)
+	}
+	if code := request(http.MethodGet, "/rules"); code != 200 {
+		t.Fatalf("expected the stats of the rules, got %d", code)
+	}
+	// replacing the rules stops the limiters of the previous ones
+	server.SetRules(nil)
+	select {
+	case <-engine.rules[0].Limiter.(*TBLimiter).buckets.stop:
+	default:
+		t.Fatal("expected the limiters of the previous rules to be stopped")
+	}
+}
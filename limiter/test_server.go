@@ -2,21 +2,67 @@ package limiter
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/vamsaty/cc-rate-limiter/keys"
+	"net/http"
+	"strconv"
 	"sync"
 )
 
 type Server struct {
 	limiterLock *sync.RWMutex
 	r           *gin.Engine
+	// admin serves the routes changing the server's state, apart from r so
+	// that it can be served on an address the clients can not reach
+	admin *gin.Engine
 	RateLimiter
 	PreviousRateLimiter RateLimiter
+	// access are the allow and deny rules the requests are checked against
+	// before reaching the limiter, nil if there are none
+	access *AccessRules
+	// rules select the limiter of the requests they match, nil if there are none
+	rules *RuleEngine
+	// Key extracts the key /limited rate limits requests by. By default it is
+	// the X-User header, or the client's IP address for anonymous requests.
+	Key keys.Func
+	// OrgKey extracts the organisation of the requests to a
+	// HierarchicalLimiter, which are keyed "org/user". By default it is the
+	// X-Org header. The other limiters are keyed by Key alone.
+	OrgKey keys.Func
+	// ClientIP extracts the client's IP address the access rules are checked
+	// against. By default it is the address the request comes from, proxies
+	// are not trusted.
+	ClientIP keys.Func
+	// Upstream, if set, serves the allowed requests instead of the decision
+	// being written back. Its latency and status (5xx being errors) are fed
+	// back to the limiters taking feedback.
+	Upstream http.Handler
+	// LegacyHeaders makes /limited set the X-RateLimit-* headers, on top of
+	// the RateLimit-* ones
+	LegacyHeaders bool
+	// clock tells the time the RateLimit-Reset header counts from, it should
+	// be the clock of the limiter
+	clock Clock
 }
 
-func NewServer(rateLimiter RateLimiter) *Server {
-	return &Server{
+// NewServer creates a Server rate limiting /limited with the limiter. The
+// options should be the ones the limiter was created with.
+func NewServer(rateLimiter RateLimiter, opts ...Option) *Server {
+	o := &options{clock: RealClock()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	remoteIP, _ := keys.IP()
+	s := &Server{
 		limiterLock: &sync.RWMutex{},
 		RateLimiter: rateLimiter,
+		Key:         keys.Fallback(keys.Header("X-User"), remoteIP),
+		OrgKey:      keys.Header("X-Org"),
+		ClientIP:    remoteIP,
+		clock:       o.clock,
 	}
+	s.r = s.newRouter()
+	s.admin = s.newAdminRouter()
+	return s
 }
 
 func Pack(code int, before, after interface{}) map[string]interface{} {
@@ -27,33 +73,254 @@ func Pack(code int, before, after interface{}) map[string]interface{} {
 	}
 }
 
-func (s *Server) Start(address string) error {
+// newRouter creates the gin engine serving the server's routes
+func (s *Server) newRouter() *gin.Engine {
 	router := gin.New()
 	router.Use(
 		gin.LoggerWithWriter(gin.DefaultWriter, "/limited"),
 		gin.Recovery(),
 	)
-	s.r = router
-	s.r.GET("/limited", func(c *gin.Context) {
-		s.limiterLock.Lock()
-		defer s.limiterLock.Unlock()
-		before := s.RateLimiter.Stats()
-		id := c.GetHeader("X-User")
-		if s.RateLimiter.Allow(id) != nil {
-			c.IndentedJSON(429, Pack(429, before, s.RateLimiter.Stats()))
-		} else {
-			c.IndentedJSON(200, Pack(200, before, s.RateLimiter.Stats()))
+	router.GET("/limited", func(c *gin.Context) {
+		if rule := s.Rules().Match(c.Request); rule != nil {
+			s.serveLimited(c, rule.Limiter, rule.Key)
+			return
+		}
+		s.serveLimited(c, s.limiter(), s.Key)
+	})
+	// the other routes are only rate limited by the rules matching them
+	router.NoRoute(func(c *gin.Context) {
+		rule := s.Rules().Match(c.Request)
+		if rule == nil {
+			c.JSON(404, gin.H{"status": 404, "error": "no such route"})
+			return
 		}
+		s.serveLimited(c, rule.Limiter, rule.Key)
 	})
-	s.r.GET("/unlimited", func(c *gin.Context) {
+	router.GET("/unlimited", func(c *gin.Context) {
 		c.IndentedJSON(200, Pack(200, nil, nil))
 	})
-	s.r.GET("/stats", func(c *gin.Context) {
-		c.IndentedJSON(200, s.RateLimiter.Stats())
+	router.GET("/stats", func(c *gin.Context) {
+		c.IndentedJSON(200, s.limiter().Stats())
+	})
+	router.GET("/rules", func(c *gin.Context) {
+		c.IndentedJSON(200, s.Rules().Stats())
+	})
+	router.GET("/quota/:key", s.withQuota(func(c *gin.Context, q *QuotaLimiter) {
+		c.JSON(200, gin.H{"status": 200, "remaining": q.Remaining(c.Param("key"))})
+	}))
+	return router
+}
+
+// newAdminRouter creates the gin engine serving the server's admin routes
+func (s *Server) newAdminRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(gin.Logger(), gin.Recovery())
+	router.GET("/access", func(c *gin.Context) {
+		c.JSON(200, gin.H{"status": 200, "rules": s.AccessRules().Strings()})
+	})
+	router.PUT("/access", func(c *gin.Context) {
+		rules, err := ParseAccessRules(c.Request.Body)
+		if err != nil {
+			c.JSON(400, gin.H{"status": 400, "error": err.Error()})
+			return
+		}
+		s.SetAccessRules(rules)
+		c.JSON(200, gin.H{"status": 200, "rules": rules.Strings()})
+	})
+	router.POST("/access/reload", func(c *gin.Context) {
+		rules, err := s.AccessRules().Reload()
+		if err != nil {
+			c.JSON(400, gin.H{"status": 400, "error": err.Error()})
+			return
+		}
+		s.SetAccessRules(rules)
+		c.JSON(200, gin.H{"status": 200, "rules": rules.Strings()})
 	})
+	router.POST("/quota/:key/top_up", s.withQuota(func(c *gin.Context, q *QuotaLimiter) {
+		amount, err := strconv.Atoi(c.Query("amount"))
+		if err == nil {
+			err = q.TopUp(c.Param("key"), amount)
+		}
+		if err != nil {
+			c.JSON(400, gin.H{"status": 400, "error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"status": 200, "remaining": q.Remaining(c.Param("key"))})
+	}))
+	router.POST("/quota/:key/reset", s.withQuota(func(c *gin.Context, q *QuotaLimiter) {
+		q.Reset(c.Param("key"))
+		c.JSON(200, gin.H{"status": 200, "remaining": q.Remaining(c.Param("key"))})
+	}))
+	router.GET("/bans", s.withPenaltyBox(func(c *gin.Context, p *PenaltyBox) {
+		c.JSON(200, gin.H{"status": 200, "bans": p.Bans()})
+	}))
+	router.DELETE("/bans/:key", s.withPenaltyBox(func(c *gin.Context, p *PenaltyBox) {
+		if !p.Unban(c.Param("key")) {
+			c.JSON(404, gin.H{"status": 404, "error": "the key is not banned"})
+			return
+		}
+		c.JSON(200, gin.H{"status": 200, "bans": p.Bans()})
+	}))
+	return router
+}
+
+// serveLimited rate limits the request with the limiter, by the key
+// extracted by key, and responds with the decision
+func (s *Server) serveLimited(c *gin.Context, limiter RateLimiter, key keys.Func) {
+	user, ok := key(c.Request)
+	if !ok {
+		c.JSON(400, gin.H{"status": 400, "error": "the request has no rate limit key"})
+		return
+	}
+	// allowed keys and addresses skip the limiter, denied ones are rejected
+	ip, _ := s.ClientIP(c.Request)
+	switch s.AccessRules().Match(user, ip) {
+	case AccessAllow:
+		limit := limiter.GetLimit()
+		c.JSON(200, gin.H{"status": 200, "decision": Decision{Allowed: true, Limit: limit, Remaining: limit}})
+		return
+	case AccessDeny:
+		c.JSON(403, gin.H{"status": 403, "error": ErrDenied.Error()})
+		return
+	}
+	// users of an organisation are keyed "org/user" by the hierarchical limiter
+	if _, ok := unwrap[*HierarchicalLimiter](limiter); ok && s.OrgKey != nil {
+		if org, ok := s.OrgKey(c.Request); ok {
+			user = org + "/" + user
+		}
+	}
+	var d Decision
+	if l, ok := limiter.(PriorityAware); ok {
+		d = l.DecidePriority(user, ParsePriority(c.GetHeader("X-Priority")))
+	} else {
+		d = limiter.Decide(user)
+	}
+	// release the in flight slot once the response is written
+	if l, ok := limiter.(InFlightLimiter); ok && d.Allowed {
+		defer l.Done(user)
+	}
+	SetHeaders(c.Writer.Header(), d, Policy(limiter), s.clock.Now(), s.LegacyHeaders)
+	if !d.Allowed {
+		c.JSON(429, gin.H{"status": 429, "decision": d})
+		return
+	}
+
+	start := s.clock.Now()
+	if s.Upstream != nil {
+		s.Upstream.ServeHTTP(c.Writer, c.Request)
+	} else {
+		c.JSON(200, gin.H{"status": 200, "decision": d})
+	}
+	if l, ok := FeedbackOf(limiter); ok {
+		l.Feedback(s.clock.Now().Sub(start), StatusError(c.Writer.Status()))
+	}
+}
+
+// withQuota serves the route with the server's quota limiter, or responds
+// with 404 if the server does not limit by quota
+func (s *Server) withQuota(handle func(*gin.Context, *QuotaLimiter)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, ok := unwrap[*QuotaLimiter](s.limiter())
+		if !ok {
+			c.JSON(404, gin.H{"status": 404, "error": "the rate limiter has no quota"})
+			return
+		}
+		handle(c, q)
+	}
+}
+
+// withPenaltyBox serves the route with the server's penalty box, or responds
+// with 404 if the server does not ban keys
+func (s *Server) withPenaltyBox(handle func(*gin.Context, *PenaltyBox)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, ok := unwrap[*PenaltyBox](s.limiter())
+		if !ok {
+			c.JSON(404, gin.H{"status": 404, "error": "the rate limiter does not ban keys"})
+			return
+		}
+		handle(c, p)
+	}
+}
+
+// unwrap returns the limiter of type T, among the limiter and the limiters it
+// wraps
+func unwrap[T RateLimiter](limiter RateLimiter) (T, bool) {
+	for {
+		if l, ok := limiter.(T); ok {
+			return l, true
+		}
+		wrapper, ok := limiter.(interface{ Unwrap() RateLimiter })
+		if !ok {
+			var zero T
+			return zero, false
+		}
+		limiter = wrapper.Unwrap()
+	}
+}
+
+// limiter returns the current rate limiter of the server. The limiters are
+// safe for concurrent use, the lock only guards against the limiter being
+// swapped by UpdateRateLimiter.
+func (s *Server) limiter() RateLimiter {
+	s.limiterLock.RLock()
+	defer s.limiterLock.RUnlock()
+	return s.RateLimiter
+}
+
+// Handler returns the http.Handler serving the server's routes, without
+// binding a port. Useful for testing with httptest.
+func (s *Server) Handler() http.Handler { return s.r }
+
+// AdminHandler returns the http.Handler serving the server's admin routes,
+// which must not be reachable by the clients being rate limited
+func (s *Server) AdminHandler() http.Handler { return s.admin }
+
+// Start serves the server's routes on the address
+func (s *Server) Start(address string) error {
 	return s.r.Run(address)
 }
 
+// StartAdmin serves the server's admin routes on the address
+func (s *Server) StartAdmin(address string) error {
+	return s.admin.Run(address)
+}
+
+// AccessRules returns the allow and deny rules of the server
+func (s *Server) AccessRules() *AccessRules {
+	s.limiterLock.RLock()
+	defer s.limiterLock.RUnlock()
+	return s.access
+}
+
+// SetAccessRules replaces the allow and deny rules of the server
+func (s *Server) SetAccessRules(rules *AccessRules) {
+	s.limiterLock.Lock()
+	defer s.limiterLock.Unlock()
+	s.access = rules
+}
+
+// Rules returns the rule engine of the server
+func (s *Server) Rules() *RuleEngine {
+	s.limiterLock.RLock()
+	defer s.limiterLock.RUnlock()
+	return s.rules
+}
+
+// SetRules replaces the rule engine of the server. The requests matching a
+// rule are rate limited by the rule's limiter and key, on any route, and the
+// other requests to /limited by the server's limiter. The previous engine is
+// stopped, the requests still using it are served nonetheless.
+func (s *Server) SetRules(rules *RuleEngine) {
+	s.limiterLock.Lock()
+	previous := s.rules
+	s.rules = rules
+	s.limiterLock.Unlock()
+
+	if previous != nil && previous != rules {
+		previous.Stop()
+	}
+}
+
 func (s *Server) UpdateRateLimiter(limiter RateLimiter) error {
 	s.limiterLock.Lock()
 	defer s.limiterLock.Unlock()
@@ -68,6 +335,10 @@ func (s *Server) Revert() {
 	s.RateLimiter = s.PreviousRateLimiter
 }
 
+// ParseRateLimiterConfig maps the algo, capacity, refill_rate,
+// max_request_count, window_size and request_per_sec args to a RateConfig.
+//
+// Deprecated: use LimiterConfig.RateConfig, which is typed and validated.
 func ParseRateLimiterConfig(args ...string) RateConfig {
 	return RateConfig{
 		"algo":              args[0],
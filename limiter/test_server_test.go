@@ -0,0 +1,192 @@
+package limiter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vamsaty/cc-rate-limiter/keys"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServerLimitsPerUser(t *testing.T) {
+	limiter, _ := newFakeClockLimiter(RateConfig{"algo": "token_bucket", "capacity": "2", "refill_rate": "1"})
+	handler := NewServer(limiter).Handler()
+
+	request := func(path, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-User", user)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, user := range []string{"alice", "bob"} {
+		for i, want := range []int{200, 200, 429} {
+			if rec := request("/limited", user); rec.Code != want {
+				t.Fatalf("%s request %d: expected %d, got %d", user, i, want, rec.Code)
+			}
+		}
+	}
+	if rec := request("/unlimited", "alice"); rec.Code != 200 {
+		t.Fatalf("expected /unlimited to be unlimited, got %d", rec.Code)
+	}
+
+	rec := request("/stats", "")
+	stats := map[string]interface{}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats["alice"] == nil || stats["bob"] == nil {
+		t.Fatalf("expected stats for alice and bob, got %v", stats)
+	}
+}
+
+func TestServerReleasesInFlightSlots(t *testing.T) {
+	limiter, _ := newFakeClockLimiter(RateConfig{"algo": "concurrency", "max_in_flight": "1"})
+	handler := NewServer(limiter).Handler()
+
+	// each request is done before the next one starts, so none is rejected
+	if data := getStatusCodeMap(handler, 5); data[200] != 5 {
+		t.Fatalf("expected every request to be allowed, got %v", data)
+	}
+	if err := limiter.Allow(""); err != nil {
+		t.Fatalf("expected the slot to be free after the responses, got %v", err)
+	}
+}
+
+func TestServerFeedback(t *testing.T) {
+	// the penalty box wraps the adaptive limiter, which still gets the feedback
+	rl, clock := newFakeClockLimiter(RateConfig{
+		"algo": "adaptive", "capacity": "10", "refill_rate": "10", "adjust_interval": "1s", "ban_threshold": "100",
+	})
+	defer rl.Stop()
+	adaptive, _ := unwrap[*AdaptiveLimiter](rl)
+	server := NewServer(rl, WithClock(clock))
+	failing := true
+	server.Upstream = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		clock.Advance(time.Second)
+		if failing {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	})
+	handler := server.Handler()
+
+	request := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/limited", nil)
+		req.Header.Set("X-User", "alice")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for i := 0; i < 2; i++ {
+		if code := request(); code != http.StatusBadGateway {
+			t.Fatalf("expected the upstream's response, got %d", code)
+		}
+	}
+	if rate := adaptive.Limit(); rate != 2.5 {
+		t.Fatalf("expected the rate to be halved twice after 5xx responses, got %v", rate)
+	}
+	failing = false
+	if code := request(); code != http.StatusOK {
+		t.Fatalf("expected the upstream's response, got %d", code)
+	}
+	if rate := adaptive.Limit(); rate != 3.5 {
+		t.Fatalf("expected the rate to go up after a success, got %v", rate)
+	}
+}
+
+func TestServerQuota(t *testing.T) {
+	limiter, _ := newFakeClockLimiter(RateConfig{"algo": "quota", "quota": "2", "quota_period": "day"})
+	server := NewServer(limiter)
+	handler, admin := server.Handler(), server.AdminHandler()
+
+	request := func(handler http.Handler, method, path string) map[string]interface{} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		body := map[string]interface{}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	_ = limiter.Allow("alice")
+	if body := request(handler, http.MethodGet, "/quota/alice"); body["remaining"] != 1.0 {
+		t.Fatalf("expected 1 request left, got %v", body)
+	}
+	// the clients can not grant themselves more quota
+	if body := request(handler, http.MethodPost, "/quota/alice/top_up?amount=5"); body["status"] != 404.0 {
+		t.Fatalf("expected the rate limited routes not to top up, got %v", body)
+	}
+	if body := request(admin, http.MethodPost, "/quota/alice/top_up?amount=5"); body["remaining"] != 6.0 {
+		t.Fatalf("expected 6 requests left after the top up, got %v", body)
+	}
+	if body := request(admin, http.MethodPost, "/quota/alice/top_up?amount=-1"); body["status"] != 400.0 {
+		t.Fatalf("expected a negative top up to be refused, got %v", body)
+	}
+	if body := request(admin, http.MethodPost, fmt.Sprintf("/quota/alice/top_up?amount=%d", math.MaxInt)); body["status"] != 400.0 {
+		t.Fatalf("expected a top up overflowing the quota to be refused, got %v", body)
+	}
+	if body := request(admin, http.MethodPost, "/quota/alice/reset"); body["remaining"] != 2.0 {
+		t.Fatalf("expected the full quota after a reset, got %v", body)
+	}
+
+	other := NewServer(NewRateLimiterFromConfig(RateConfig{})).Handler()
+	rec := httptest.NewRecorder()
+	other.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/quota/alice", nil))
+	if rec.Code != 404 {
+		t.Fatalf("expected 404 without a quota limiter, got %d", rec.Code)
+	}
+}
+
+func TestServerPriorityHeader(t *testing.T) {
+	limiter, _ := newFakeClockLimiter(RateConfig{"algo": "priority", "capacity": "2", "refill_rate": "0.001", "critical_reserve": "0.5"})
+	handler := NewServer(limiter).Handler()
+
+	for i, tc := range []struct {
+		priority string
+		want     int
+	}{
+		{"", 200},
+		// the remaining token is reserved for critical requests
+		{"sheddable", 429},
+		{"", 429},
+		{"critical", 200},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/limited", nil)
+		req.Header.Set("X-Priority", tc.priority)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Fatalf("request %d (%q): expected %d, got %d", i, tc.priority, tc.want, rec.Code)
+		}
+	}
+}
+
+func TestServerKey(t *testing.T) {
+	limiter, _ := newFakeClockLimiter(RateConfig{"algo": "token_bucket", "capacity": "1", "refill_rate": "0.001"})
+	server := NewServer(limiter)
+	handler := server.Handler()
+
+	request := func(path, user string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-User", user)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	// anonymous requests are keyed by IP address, not all by ""
+	if request("/limited", "") != 200 || request("/limited", "alice") != 200 || request("/limited", "") != 429 {
+		t.Fatal("expected anonymous requests to share the limit of their IP address only")
+	}
+
+	server.Key = keys.Query("api")
+	if code := request("/limited?api=one", "alice"); code != 200 {
+		t.Fatalf("expected the request to be keyed by the query parameter, got %d", code)
+	}
+	if code := request("/limited", "alice"); code != 400 {
+		t.Fatalf("expected 400 without a key, got %d", code)
+	}
+}
@@ -4,33 +4,83 @@ import (
 	"fmt"
 	ccUtils "github.com/vamsaty/cc-utils"
 	"net/http"
-	"net/url"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 )
 
-var getStatusCodeMap = func(numReq int) map[int]int {
-	client := http.DefaultClient
+// getStatusCodeMap makes numReq requests to the /limited route of the handler
+// (in process, no port is bound) and counts the responses per status code
+var getStatusCodeMap = func(handler http.Handler, numReq int) map[int]int {
 	respMap := map[int]int{}
 
 	for i := 0; i < numReq; i++ {
-		resp, _ := client.Do(&http.Request{
-			Method: http.MethodGet,
-			URL:    &url.URL{Scheme: "http", Host: "localhost:8080", Path: "/limited"},
-		})
-		respMap[resp.StatusCode]++
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/limited", nil))
+		respMap[rec.Code]++
 	}
 	return respMap
 }
 
-// IsValid checks the expected number of 200 and 429 status code responses
-func IsValid(maxAllowedReq, numReq int) error {
-	// 200 status code count should be minimum of numReq and maximum allowed
-	c200 := ccUtils.Min(numReq, maxAllowedReq)
-	// 429 status code count is 0 if numReq < maximum allowed requests. Otherwise,
+// expectedCounts returns the expected number of allowed and rejected requests
+func expectedCounts(maxAllowedReq, numReq int) (int, int) {
+	// allowed count should be minimum of numReq and maximum allowed
+	allowed := ccUtils.Min(numReq, maxAllowedReq)
+	// rejected count is 0 if numReq < maximum allowed requests. Otherwise,
 	// its numReq - maxAllowedReq. i.e. the number of requests that were blocked.
-	c429 := ccUtils.Max(0, numReq-maxAllowedReq)
-	data := getStatusCodeMap(numReq)
+	rejected := ccUtils.Max(0, numReq-maxAllowedReq)
+	return allowed, rejected
+}
+
+// IsValid checks the expected number of allowed and rejected requests, when
+// calling the limiter directly
+func IsValid(limiter RateLimiter, numReq int) error {
+	allowed, rejected := expectedCounts(limiter.GetLimit(), numReq)
+	gotAllowed := 0
+	for i := 0; i < numReq; i++ {
+		if limiter.Allow("") == nil {
+			gotAllowed++
+		}
+	}
+	if gotAllowed == allowed && numReq-gotAllowed == rejected {
+		return nil
+	}
+	return fmt.Errorf("expected allowed=%d and rejected=%d, got allowed=%d and rejected=%d",
+		allowed, rejected, gotAllowed, numReq-gotAllowed)
+}
+
+// IsValidConcurrent checks the expected number of allowed and rejected
+// requests, when calling the limiter from numReq goroutines at once
+func IsValidConcurrent(limiter RateLimiter, numReq int) error {
+	allowed, rejected := expectedCounts(limiter.GetLimit(), numReq)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	gotAllowed := 0
+	for i := 0; i < numReq; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if limiter.Allow("") == nil {
+				mu.Lock()
+				gotAllowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if gotAllowed == allowed && numReq-gotAllowed == rejected {
+		return nil
+	}
+	return fmt.Errorf("expected allowed=%d and rejected=%d, got allowed=%d and rejected=%d",
+		allowed, rejected, gotAllowed, numReq-gotAllowed)
+}
+
+// IsValidOverHTTP checks the expected number of 200 and 429 status code
+// responses, when serving the limiter's /limited route in process
+func IsValidOverHTTP(limiter RateLimiter, numReq int) error {
+	c200, c429 := expectedCounts(limiter.GetLimit(), numReq)
+	data := getStatusCodeMap(NewServer(limiter).Handler(), numReq)
 	if data[200] == c200 && data[429] == c429 {
 		return nil
 	}
@@ -46,24 +96,36 @@ type TestCase struct {
 	numReq int
 }
 
-// runTestCases updates the rate limiter for the server and runs the test cases
-func runTestCases(t *testing.T, testCases []TestCase, validatorFunc func(int, int) error) {
-	server := NewServer(&DummyRateLimit{})
-	go server.Start(":8080")
+// defaultValidators check the limiter when called directly, concurrently and
+// over HTTP
+var defaultValidators = map[string]func(RateLimiter, int) error{
+	"direct":     IsValid,
+	"concurrent": IsValidConcurrent,
+	"http":       IsValidOverHTTP,
+}
 
-	// for safety - sleep for server to come up.
-	time.Sleep(1 * time.Second)
+// newFakeClockLimiter creates a limiter from the config using a fake clock
+func newFakeClockLimiter(config RateConfig) (RateLimiter, *FakeClock) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	return NewRateLimiterFromConfig(config, WithClock(clock)), clock
+}
 
+// runTestCases creates a rate limiter for each test case and validator, and
+// runs the validator against it. The limiters use a fake clock, so time does
+// not pass while a test case runs.
+func runTestCases(t *testing.T, testCases []TestCase, validators map[string]func(RateLimiter, int) error) {
 	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			// NOTE: this supports updating the RateLimiter for the server on the fly
-			// only for easier testing.
-			limiter := NewRateLimiterFromConfig(tc.config)
-			_ = server.UpdateRateLimiter(limiter)
+		for name, validatorFunc := range validators {
+			tc, validatorFunc := tc, validatorFunc
+			t.Run(tc.name+"/"+name, func(t *testing.T) {
+				t.Parallel()
+				limiter, _ := newFakeClockLimiter(tc.config)
+				defer limiter.Stop()
 
-			if err := validatorFunc(limiter.GetLimit(), tc.numReq); err != nil {
-				t.Fatal(err)
-			}
-		})
+				if err := validatorFunc(limiter, tc.numReq); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
 	}
 }
@@ -2,36 +2,171 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"github.com/vamsaty/cc-rate-limiter/keys"
 	"github.com/vamsaty/cc-rate-limiter/limiter"
+	ccUtils "github.com/vamsaty/cc-utils"
 )
 
-var (
-	rateLimitAlgo = flag.String("algo", "token_bucket", "rate limit algorithm")
+// configFile is the configuration file, which the flags set override
+var configFile = flag.String("config", "", "YAML or JSON configuration file, the flags set override it (see limiter.Config)")
+
+// init defines the flags of the fields of limiter.Config, named after them,
+// with the values of limiter.DefaultConfig as defaults
+func init() {
+	defaults := limiter.DefaultConfig()
+	values := defaults.Flags()
+	define := func(name, usage string) {
+		value, ok := values[name]
+		if !ok {
+			panic(fmt.Errorf("no field of limiter.Config has the flag %q", name))
+		}
+		flag.String(name, value, usage)
+	}
+
+	define("address", "address the test server listens on")
+	define("admin_address", "address the admin routes are served on, which the clients must not reach (empty to not serve them)")
+
+	define("algo", "rate limit algorithm")
 
 	/*token bucket flags*/
-	capacity   = flag.String("capacity", "10", "bucket capacity")
-	refillRate = flag.String("refill_rate", "1", "tokens to push per second")
+	define("capacity", "bucket capacity")
+	define("refill_rate", "tokens to push per second")
 
-	/*fixed window counter flags*/
-	maxRequestCount = flag.String("max_request_count", "10", "maximum number of requests per window size")
+	/*fixed window counter and sliding window counter flags*/
+	define("max_request_count", "maximum number of requests per window size")
 
 	/*sliding window log flags*/
-	requestPerSec = flag.String("request_per_sec", "10", "maximum number of requests per second")
+	define("request_per_sec", "maximum number of requests per second")
 
-	// windowSize is the size of the window - used for "fixed window counter" and "sliding window log"
-	windowSize = flag.String("window_size", "1s", "window size to capture the requests")
-)
+	// window_size is the size of the window - used for "fixed window counter", "sliding window log"
+	// and "sliding window counter"
+	define("window_size", "window size to capture the requests")
+
+	/*leaky bucket flags (also uses capacity)*/
+	define("leak_rate", "requests leaked (released) per second")
+	define("leaky_mode", "meter (reject on overflow) or queue (delay requests, release them at the leak rate)")
+	define("queue_timeout", "maximum time a request waits in queue mode (0 means no limit)")
+
+	/*concurrency flags*/
+	define("max_in_flight", "maximum number of requests in flight per key")
+	define("global_max_in_flight", "maximum number of requests in flight across all keys (0 means no limit)")
+
+	/*adaptive flags (also uses capacity and refill_rate, the initial rate)*/
+	define("min_rate", "lowest refill rate the adaptive limiter goes down to (default 1)")
+	define("max_rate", "highest refill rate the adaptive limiter goes up to (default 10 times refill_rate)")
+	define("rate_increase", "refill rate added while the downstream is healthy (default 1)")
+	define("rate_decrease", "factor the refill rate is multiplied by once the downstream is unhealthy (default 0.5)")
+	define("target_latency", "smoothed latency above which the downstream is unhealthy (default none, only errors count)")
+	define("latency_smoothing", "weight of a new latency in the moving average (default 0.2)")
+	define("adjust_interval", "minimum time between two adjustments of the refill rate (default 1s)")
+
+	/*quota flags*/
+	define("quota", "maximum number of requests per calendar period")
+	define("quota_period", "calendar period of the quota: minute, hour, day, week or month")
+	define("timezone", "timezone the quota periods are aligned in")
+	define("max_quotas", "maximum number of keys whose quota is tracked, new keys are rejected beyond it (0 means no limit)")
+
+	/*hierarchical flags*/
+	define("user_capacity", "bucket capacity of a user")
+	define("user_refill_rate", "tokens pushed per second into the bucket of a user")
+	define("org_capacity", "bucket capacity of an organisation (default none, organisations are not limited)")
+	define("org_refill_rate", "tokens pushed per second into the bucket of an organisation")
+	define("global_capacity", "capacity of the global bucket (default none, not limited)")
+	define("global_refill_rate", "tokens pushed per second into the global bucket")
+	define("sharing", "strict (every level must allow a request) or borrow (a level may borrow the unused capacity of the level above)")
+
+	/*priority flags (also uses capacity and refill_rate, for the global bucket)*/
+	define("critical_reserve", "fraction of the capacity reserved for critical requests")
+	define("default_reserve", "fraction of the capacity reserved for default requests, on top of the critical reserve")
+
+	/*fair queue flags (also uses capacity and refill_rate, for the global bucket)*/
+	define("queue_size", "maximum number of requests queued across all keys")
+	define("max_wait", "maximum time a request waits in the queue (0 means no limit)")
+	define("weights", "weights of keys in the fair queue, e.g. alice=3,bob=2")
+	define("default_weight", "weight of the keys not listed in weights")
+
+	/*composite flags*/
+	define("limits", "limits enforced at once, e.g. token_bucket:capacity=10,refill_rate=10;fixed_window_counter:max_request_count=1000,window_size=24h")
+
+	/*penalty box flags, common to all the algorithms*/
+	define("ban_threshold", "rejections within ban_window that get a key banned (0 disables bans)")
+	define("ban_window", "window the rejections of a key are counted in")
+	define("ban_duration", "duration of the first ban of a key")
+	define("ban_multiplier", "factor every following ban of a key is longer by")
+	define("max_ban_duration", "longest ban, a key not banned again for as long starts over")
+
+	/*access list flags*/
+	define("access_list", "file of allow and deny rules checked before the rate limiter, e.g. allow 10.0.0.0/8")
+
+	/*rule engine flags*/
+	define("rules", "JSON file of rules selecting the limiter and key of requests by method, path, host and headers")
+
+	/*key extraction flags*/
+	define("key", "what requests are keyed by, e.g. jwt:sub+route|ip (see the keys package)")
+	define("org_key", "what the organisation of a request is, for the hierarchical limiter (empty for none)")
+	define("trusted_proxies", "comma separated CIDR ranges of the proxies whose X-Forwarded-For and Forwarded headers are trusted")
+	define("jwt_secret", "secret the HS256 signature of JWTs is verified with, for the jwt key")
+
+	/*response header flags*/
+	flag.Bool("legacy_headers", defaults.Server.LegacyHeaders, "set the X-RateLimit-* headers, on top of the RateLimit-* ones")
+
+	/*per-key state storage flags*/
+	define("idle_ttl", "time after which an idle key is forgotten (0 disables idle eviction)")
+	define("max_keys", "maximum number of keys tracked, least recently used keys are evicted beyond it (0 means no limit)")
+	define("shards", "number of independently locked shards the keys are spread over")
+}
 
 func main() {
 	flag.Parse()
-	config := limiter.ParseRateLimiterConfig(
-		*rateLimitAlgo,
-		*capacity,
-		*refillRate,
-		*maxRequestCount,
-		*windowSize,
-		*requestPerSec,
-	)
-	rl := limiter.NewRateLimiterFromConfig(config)
-	limiter.NewServer(rl).Start(":8080")
+
+	// without a file, the flags are the config, defaults included
+	config, visit := limiter.DefaultConfig(), flag.VisitAll
+	if *configFile != "" {
+		var err error
+		config, err = limiter.LoadConfig(*configFile)
+		ccUtils.PanicIf(err)
+		visit = flag.Visit
+	}
+	visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			ccUtils.PanicIf(config.Set(f.Name, f.Value.String()))
+		}
+	})
+	ccUtils.PanicIf(config.Validate())
+
+	rl, err := limiter.NewRateLimiter(config.Limiter.RateConfig())
+	ccUtils.PanicIf(err)
+	server := limiter.NewServer(rl)
+	server.LegacyHeaders = config.Server.LegacyHeaders
+	keysConfig := keys.Config{
+		TrustedProxies: config.Server.TrustedProxies,
+		JWTSecret:      []byte(config.Server.JWTSecret),
+	}
+	keyFunc, err := keys.Parse(config.Server.Key, keysConfig)
+	ccUtils.PanicIf(err)
+	server.Key = keyFunc
+	server.ClientIP, err = keys.IP(config.Server.TrustedProxies...)
+	ccUtils.PanicIf(err)
+	server.OrgKey = nil
+	if config.Server.OrgKey != "" {
+		server.OrgKey, err = keys.Parse(config.Server.OrgKey, keysConfig)
+		ccUtils.PanicIf(err)
+	}
+	if config.Server.AccessList != "" {
+		rules, err := limiter.LoadAccessRules(config.Server.AccessList)
+		ccUtils.PanicIf(err)
+		server.SetAccessRules(rules)
+	}
+	if config.Server.Rules != "" {
+		rulesConfig, err := limiter.LoadRulesConfig(config.Server.Rules)
+		ccUtils.PanicIf(err)
+		engine, err := limiter.NewRuleEngine(rulesConfig, keyFunc, keysConfig)
+		ccUtils.PanicIf(err)
+		server.SetRules(engine)
+	}
+	if config.Server.AdminAddress != "" {
+		go func() { ccUtils.PanicIf(server.StartAdmin(config.Server.AdminAddress)) }()
+	}
+	server.Start(config.Server.Address)
 }
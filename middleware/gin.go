@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/vamsaty/cc-rate-limiter/keys"
+	"github.com/vamsaty/cc-rate-limiter/limiter"
+)
+
+// Gin returns a gin middleware checking every request against the limiter,
+// see Handler. Rejected requests are aborted.
+func Gin(rl limiter.RateLimiter, key keys.Func, reject RejectFunc, opts ...Option) gin.HandlerFunc {
+	g := newGuard(rl, key, reject, opts)
+	return func(c *gin.Context) {
+		next := func() int {
+			c.Next()
+			return c.Writer.Status()
+		}
+		if !g.serve(c.Writer, c.Request, next) {
+			c.Abort()
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"github.com/vamsaty/cc-rate-limiter/keys"
+	"github.com/vamsaty/cc-rate-limiter/limiter"
+	"net/http"
+)
+
+// Handler returns a net/http middleware checking every request against the
+// limiter, by the key extracted by key (the client's IP address if nil).
+// Rejected requests are answered by reject (Reject if nil) and do not reach
+// the next handler, nor do the requests without a key (see WithMissingKey).
+func Handler(rl limiter.RateLimiter, key keys.Func, reject RejectFunc, opts ...Option) func(http.Handler) http.Handler {
+	g := newGuard(rl, key, reject, opts)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			g.serve(w, r, func() int {
+				// the status is only recorded for the limiters taking
+				// feedback, the writer loses its optional interfaces
+				if g.feedback == nil {
+					next.ServeHTTP(w, r)
+					return 0
+				}
+				sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+				next.ServeHTTP(sw, r)
+				return sw.status
+			})
+		})
+	}
+}
+
+// statusWriter records the status of the response
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(data)
+}
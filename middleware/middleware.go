@@ -0,0 +1,155 @@
+// Package middleware protects net/http and gin routes with the rate limiters
+// of the limiter package.
+package middleware
+
+import (
+	"encoding/json"
+	"github.com/vamsaty/cc-rate-limiter/keys"
+	"github.com/vamsaty/cc-rate-limiter/limiter"
+	"net/http"
+)
+
+// RejectFunc writes the response to a rejected request
+type RejectFunc func(http.ResponseWriter, *http.Request, limiter.Decision)
+
+// remoteIP keys requests by the IP address they come from, trusting no proxy
+var remoteIP, _ = keys.IP()
+
+// Reject responds with 429 Too Many Requests and the decision as JSON, like
+// the limiter's test server
+func Reject(w http.ResponseWriter, _ *http.Request, d limiter.Decision) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   http.StatusTooManyRequests,
+		"decision": d,
+	})
+}
+
+// MissingKey responds with 400 Bad Request to a request without a key
+func MissingKey(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": http.StatusBadRequest,
+		"error":  "the request has no rate limit key",
+	})
+}
+
+// Option customizes the middleware
+type Option func(*options)
+
+type options struct {
+	missing  http.HandlerFunc
+	priority func(*http.Request) limiter.Priority
+	legacy   bool
+	clock    limiter.Clock
+}
+
+// WithMissingKey answers the requests the key extractor finds no key for with
+// the handler, instead of MissingKey. To rate limit them, give the extractor
+// a fallback instead (see keys.Fallback).
+func WithMissingKey(handler http.HandlerFunc) Option {
+	return func(o *options) { o.missing = handler }
+}
+
+// WithLegacyHeaders sets the X-RateLimit-* headers, on top of the RateLimit-*
+// ones
+func WithLegacyHeaders() Option {
+	return func(o *options) { o.legacy = true }
+}
+
+// WithClock tells the time the RateLimit-Reset header counts from with the
+// clock, which should be the limiter's. By default it is the real clock.
+func WithClock(clock limiter.Clock) Option {
+	return func(o *options) { o.clock = clock }
+}
+
+// WithPriority sets the priority class of requests, for the limiters taking
+// priorities into account. By default requests are of the default class.
+func WithPriority(priority func(*http.Request) limiter.Priority) Option {
+	return func(o *options) { o.priority = priority }
+}
+
+// PriorityHeader reads the priority class of requests from the header
+func PriorityHeader(name string) func(*http.Request) limiter.Priority {
+	return func(r *http.Request) limiter.Priority {
+		return limiter.ParsePriority(r.Header.Get(name))
+	}
+}
+
+// guard checks requests against a limiter
+type guard struct {
+	limiter limiter.RateLimiter
+	key     keys.Func
+	reject  RejectFunc
+	// feedback is the limiter the outcome of the allowed requests is reported
+	// to, nil if the limiter takes no feedback
+	feedback limiter.FeedbackLimiter
+	options
+}
+
+// newGuard creates a guard, with the default key and rejection handler for
+// the nil ones
+func newGuard(rl limiter.RateLimiter, key keys.Func, reject RejectFunc, opts []Option) *guard {
+	g := &guard{
+		limiter: rl,
+		key:     key,
+		reject:  reject,
+		options: options{missing: MissingKey, clock: limiter.RealClock()},
+	}
+	if g.key == nil {
+		g.key = remoteIP
+	}
+	if g.reject == nil {
+		g.reject = Reject
+	}
+	if l, ok := limiter.FeedbackOf(rl); ok {
+		g.feedback = l
+	}
+	for _, opt := range opts {
+		opt(&g.options)
+	}
+	return g
+}
+
+// serve checks the request against the limiter and sets the rate limit
+// headers of the response. It answers the requests without a key and the
+// rejected ones, and calls next with the allowed ones, which returns the
+// status of the response. The latency and status are fed back to the limiter,
+// if it takes feedback. It reports if the request was allowed.
+func (g *guard) serve(w http.ResponseWriter, r *http.Request, next func() int) bool {
+	key, ok := g.key(r)
+	if !ok {
+		g.missing(w, r)
+		return false
+	}
+	d, done := g.decide(key, r)
+	limiter.SetHeaders(w.Header(), d, limiter.Policy(g.limiter), g.clock.Now(), g.legacy)
+	if !d.Allowed {
+		g.reject(w, r, d)
+		return false
+	}
+	defer done()
+	start := g.clock.Now()
+	status := next()
+	if g.feedback != nil {
+		g.feedback.Feedback(g.clock.Now().Sub(start), limiter.StatusError(status))
+	}
+	return true
+}
+
+// decide checks the request against the limiter. Once an allowed request is
+// served, done must be called to release what it holds (e.g. its in flight
+// slot).
+func (g *guard) decide(key string, r *http.Request) (d limiter.Decision, done func()) {
+	if l, ok := g.limiter.(limiter.PriorityAware); ok && g.priority != nil {
+		d = l.DecidePriority(key, g.priority(r))
+	} else {
+		d = g.limiter.Decide(key)
+	}
+	if l, ok := g.limiter.(limiter.InFlightLimiter); ok && d.Allowed {
+		return d, func() { l.Done(key) }
+	}
+	return d, func() {}
+}
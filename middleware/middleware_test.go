@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/vamsaty/cc-rate-limiter/keys"
+	"github.com/vamsaty/cc-rate-limiter/limiter"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newLimiter creates a limiter telling the time with a fake clock
+func newLimiter(config limiter.RateConfig) limiter.RateLimiter {
+	clock := limiter.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	return limiter.NewRateLimiterFromConfig(config, limiter.WithClock(clock))
+}
+
+// serve makes a request as the user to the handler and returns the status code
+func serve(handler http.Handler, user string) int {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-User", user)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+
+func TestHandler(t *testing.T) {
+	rl := newLimiter(limiter.RateConfig{"algo": "token_bucket", "capacity": "2", "refill_rate": "0.001"})
+	handler := Handler(rl, keys.Header("X-User"), nil)(ok)
+
+	for i, want := range []int{200, 200, 429} {
+		if code := serve(handler, "alice"); code != want {
+			t.Fatalf("request %d: expected %d, got %d", i, want, code)
+		}
+	}
+	if code := serve(handler, "bob"); code != 200 {
+		t.Fatalf("expected bob to have his own limit, got %d", code)
+	}
+
+	// the rate limit headers are set on every response
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-User", "alice")
+	rec := httptest.NewRecorder()
+	Handler(rl, keys.Header("X-User"), nil, WithLegacyHeaders())(ok).ServeHTTP(rec, req)
+	for header, want := range map[string]string{
+		"RateLimit-Limit": "2", "RateLimit-Remaining": "0", "RateLimit-Policy": "2;w=2000", "X-RateLimit-Limit": "2",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("expected %s to be %q, got %q", header, want, got)
+		}
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("expected the rejection to have a Retry-After")
+	}
+
+	// requests without a key are not served
+	if code := serve(handler, ""); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a key, got %d", code)
+	}
+
+	// the rejection handler answers the rejected requests
+	teapot := func(w http.ResponseWriter, _ *http.Request, _ limiter.Decision) { w.WriteHeader(http.StatusTeapot) }
+	handler = Handler(rl, keys.Header("X-User"), teapot)(ok)
+	if code := serve(handler, "alice"); code != http.StatusTeapot {
+		t.Fatalf("expected the rejection handler to answer, got %d", code)
+	}
+}
+
+func TestHandlerReleasesInFlightSlots(t *testing.T) {
+	rl := newLimiter(limiter.RateConfig{"algo": "concurrency", "max_in_flight": "1"})
+	var inner int
+	handler := Handler(rl, nil, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the slot is held while the request is served
+		inner = serve(Handler(rl, nil, nil)(ok), "")
+	}))
+
+	for i := 0; i < 3; i++ {
+		if code := serve(handler, ""); code != 200 || inner != 429 {
+			t.Fatalf("request %d: expected 200 with the nested request rejected, got %d and %d", i, code, inner)
+		}
+	}
+}
+
+func TestHandlerFeedback(t *testing.T) {
+	// the adjust interval is short enough for every response to adjust the rate
+	rl := limiter.NewRateLimiterFromConfig(limiter.RateConfig{
+		"algo": "adaptive", "capacity": "10", "refill_rate": "10", "adjust_interval": "1ns",
+	})
+	defer rl.Stop()
+	failing := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	if code := serve(Handler(rl, keys.Header("X-User"), nil)(failing), "alice"); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the handler's response, got %d", code)
+	}
+	if rate := rl.(*limiter.AdaptiveLimiter).Limit(); rate != 5 {
+		t.Fatalf("expected the rate to be halved after a 5xx response, got %v", rate)
+	}
+
+	router := gin.New()
+	router.Use(Gin(rl, keys.Header("X-User"), nil))
+	router.GET("/", func(c *gin.Context) { c.Status(http.StatusInternalServerError) })
+	serve(router, "alice")
+	if rate := rl.(*limiter.AdaptiveLimiter).Limit(); rate != 2.5 {
+		t.Fatalf("expected the rate to be halved after a 5xx response, got %v", rate)
+	}
+}
+
+func TestGin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rl := newLimiter(limiter.RateConfig{"algo": "priority", "capacity": "2", "refill_rate": "0.001", "critical_reserve": "0.5"})
+	router := gin.New()
+	router.Use(Gin(rl, keys.Fallback(keys.Header("X-User"), keys.Const("anonymous")), nil, WithPriority(PriorityHeader("X-Priority"))))
+	served := 0
+	router.GET("/", func(c *gin.Context) {
+		served++
+		c.Status(http.StatusOK)
+	})
+
+	for i, tc := range []struct {
+		priority string
+		want     int
+	}{
+		{"", 200},
+		// half the capacity is reserved for critical requests
+		{"", 429},
+		{"critical", 200},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Priority", tc.priority)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Fatalf("request %d: expected %d, got %d", i, tc.want, rec.Code)
+		}
+	}
+	if served != 2 {
+		t.Fatalf("expected the rejected request not to be served, got %d served", served)
+	}
+}